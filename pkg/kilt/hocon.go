@@ -35,7 +35,7 @@ func NewKiltHoconWithConfig(definition string, recipeConfig string, sidecarConfi
 	return h
 }
 
-func (k *KiltHocon) prepareFullStringConfig(container *gabs.Container, groupName string) (*configuration.Config, error) {
+func (k *KiltHocon) prepareFullStringConfig(container *gabs.Container, groupName string, imageConfig map[string]interface{}) (*configuration.Config, error) {
 	rawVars := ""
 
 	jsonDoc, err := json.Marshal(container.S("Image"))
@@ -70,7 +70,11 @@ func (k *KiltHocon) prepareFullStringConfig(container *gabs.Container, groupName
 
 	rawEnvMap := make(map[string]interface{})
 	for _, env := range container.S("Environment").Children() {
-		rawEnvMap[env.S("Name").Data().(string)] = env.S("Value")
+		name, ok := env.S("Name").Data().(string)
+		if !ok {
+			return nil, fmt.Errorf("could not parse environment variable name: %v", env.S("Name").Data())
+		}
+		rawEnvMap[name] = env.S("Value")
 	}
 	jsonDoc, err = json.Marshal(rawEnvMap)
 	if err != nil {
@@ -78,6 +82,15 @@ func (k *KiltHocon) prepareFullStringConfig(container *gabs.Container, groupName
 	}
 	rawVars += "original.environment_variables:" + string(jsonDoc) + "\n"
 
+	if imageConfig == nil {
+		imageConfig = make(map[string]interface{})
+	}
+	jsonDoc, err = json.Marshal(imageConfig)
+	if err != nil {
+		return nil, fmt.Errorf("could not serialize image config: %w", err)
+	}
+	rawVars += "original.image_config:" + string(jsonDoc) + "\n"
+
 	sidecarConfig := []byte("{}")
 	if k.sidecarConfig != nil {
 		sidecarConfig, err = json.Marshal(k.sidecarConfig)
@@ -98,15 +111,19 @@ func (k *KiltHocon) prepareFullStringConfig(container *gabs.Container, groupName
 func (k *KiltHocon) patchContainerDefinitions(containers *gabs.Container, patchConfig *PatchConfig, groupName string, filter func(container *gabs.Container) bool) error {
 	sidecars := make(map[string]*gabs.Container)
 
-	for _, container := range containers.Children() {
+	for i, container := range containers.Children() {
 		if filter(container) {
-			config, err := k.prepareFullStringConfig(container, groupName)
+			var imageConfig map[string]interface{}
+			if patchConfig.ImageConfig != nil {
+				imageConfig = patchConfig.ImageConfig(container)
+			}
+			config, err := k.prepareFullStringConfig(container, groupName, imageConfig)
 			if err != nil {
-				return fmt.Errorf("could not assemble full config: %w", err)
+				return &ContainerError{i, fmt.Errorf("could not assemble full config: %w", err)}
 			}
 			newSidecars, err := applyPatch(container, config, patchConfig)
 			if err != nil {
-				return fmt.Errorf("could not patch container definition %v: %w", container, err)
+				return &ContainerError{i, fmt.Errorf("could not patch container definition %v: %w", container, err)}
 			}
 
 			for name, sidecar := range newSidecars {
@@ -127,7 +144,7 @@ func (k *KiltHocon) patchContainerDefinitions(containers *gabs.Container, patchC
 func (k *KiltHocon) PatchCfnTemplate(template *gabs.Container, patchConfig *PatchConfig) error {
 	container := gabs.New()
 	container.Set(make(map[string]interface{}))
-	config, err := k.prepareFullStringConfig(container, "")
+	config, err := k.prepareFullStringConfig(container, "", nil)
 	if err != nil {
 		return fmt.Errorf("could not assemble full config: %w", err)
 	}
@@ -142,7 +159,7 @@ func (k *KiltHocon) PatchCfnTemplate(template *gabs.Container, patchConfig *Patc
 func (k *KiltHocon) PatchTaskDefinition(taskdef *gabs.Container, patchConfig *PatchConfig, groupName string, filter func(container *gabs.Container) bool) error {
 	container := gabs.New()
 	container.Set(make(map[string]interface{}))
-	config, err := k.prepareFullStringConfig(container, "")
+	config, err := k.prepareFullStringConfig(container, "", nil)
 	if err != nil {
 		return fmt.Errorf("could not assemble full config: %w", err)
 	}
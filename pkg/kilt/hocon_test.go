@@ -86,3 +86,71 @@ func TestEnvironmentVariables(t *testing.T) {
 	container := containers.S("0")
 	assert.Equal(t, "true", *getEnvByName(container, "PREEXISTING"))
 }
+
+func TestIntrinsicEnvironmentVariableName(t *testing.T) {
+	containers, groupName := readInput("./fixtures/input.json")
+	containers.S("0").ArrayAppend(map[string]interface{}{
+		"Name":  map[string]interface{}{"Ref": "EnvName"},
+		"Value": "true",
+	}, "Environment")
+	definitionString, _ := os.ReadFile("./fixtures/kilt.cfg")
+
+	k := NewKiltHocon(string(definitionString))
+	err := k.patchContainerDefinitions(containers, &PatchConfig{}, groupName, yes)
+	assert.Error(t, err)
+}
+
+func TestContainerError(t *testing.T) {
+	containers, groupName := readInput("./fixtures/input.json")
+	broken, _ := readInput("./fixtures/input.json")
+	broken.S("0").ArrayAppend(map[string]interface{}{
+		"Name":  map[string]interface{}{"Ref": "EnvName"},
+		"Value": "true",
+	}, "Environment")
+	containers.ArrayAppend(broken.S("0").Data())
+	definitionString, _ := os.ReadFile("./fixtures/kilt.cfg")
+
+	k := NewKiltHocon(string(definitionString))
+	err := k.patchContainerDefinitions(containers, &PatchConfig{}, groupName, yes)
+	var containerErr *ContainerError
+	assert.ErrorAs(t, err, &containerErr)
+	assert.Equal(t, 1, containerErr.Index)
+}
+
+func TestImageConfig(t *testing.T) {
+	containers, groupName := readInput("./fixtures/input.json")
+	definition := `
+build {
+	entry_point: ["/falco/pdig"] ${?original.entry_point}
+	environment_variables: {
+		IMAGE_PATH: ${?original.image_config.env.PATH}
+		IMAGE_USER: ${?original.image_config.user}
+		IMAGE_OWNER: ${?original.image_config.labels.org_opencontainers_image_vendor}
+	}
+}
+`
+	imageConfig := map[string]interface{}{
+		"env":    map[string]interface{}{"PATH": "/usr/local/bin:/usr/bin"},
+		"user":   "nginx",
+		"labels": map[string]interface{}{"org_opencontainers_image_vendor": "kilt"},
+	}
+
+	k := NewKiltHocon(definition)
+	err := k.patchContainerDefinitions(containers, &PatchConfig{
+		ImageConfig: func(container *gabs.Container) map[string]interface{} {
+			return imageConfig
+		},
+	}, groupName, yes)
+	assert.NoError(t, err)
+
+	container := containers.S("0")
+	assert.Equal(t, "/usr/local/bin:/usr/bin", *getEnvByName(container, "IMAGE_PATH"))
+	assert.Equal(t, "nginx", *getEnvByName(container, "IMAGE_USER"))
+	assert.Equal(t, "kilt", *getEnvByName(container, "IMAGE_OWNER"))
+
+	// nothing known about the image, optional substitutions are empty
+	containers, groupName = readInput("./fixtures/input.json")
+	err = k.patchContainerDefinitions(containers, &PatchConfig{}, groupName, yes)
+	assert.NoError(t, err)
+	assert.Equal(t, "", *getEnvByName(containers.S("0"), "IMAGE_USER"))
+}
@@ -1,5 +1,25 @@
 package kilt
 
+import "github.com/Jeffail/gabs/v2"
+
 type PatchConfig struct {
 	ParametrizeEnvars bool
+	// ImageConfig returns what is known about the image of a container, e.g. from its registry. It is exposed to
+	// definitions as original.image_config, an empty object when ImageConfig is nil or returns nil.
+	ImageConfig func(container *gabs.Container) map[string]interface{}
+}
+
+// ContainerError is a failure to patch the container definition at Index, errors of PatchTaskDefinition that are
+// not ContainerErrors concern the task definition as a whole, e.g. injecting sidecars
+type ContainerError struct {
+	Index int
+	Err   error
+}
+
+func (e *ContainerError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ContainerError) Unwrap() error {
+	return e.Err
 }
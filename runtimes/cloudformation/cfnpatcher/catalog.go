@@ -0,0 +1,115 @@
+package cfnpatcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+// ErrNotInCatalog is returned by offline lookups of images missing from the ImageCatalog
+var ErrNotInCatalog = errors.New("image is not in the catalog")
+
+// ImageCatalog holds image configs retrieved ahead of time, so that repository hints work without registry access,
+// e.g. in CI pipelines. It is stored as JSON, see cfn-image-catalog.
+type ImageCatalog struct {
+	Images []CatalogImage `json:"images"`
+}
+
+// CatalogImage is the config of Image for Platform, the platform it was looked up for
+type CatalogImage struct {
+	Image    string       `json:"image"`
+	Platform string       `json:"platform"`
+	Config   *ImageConfig `json:"config"`
+}
+
+// LoadImageCatalog reads a catalog written by Save
+func LoadImageCatalog(path string) (*ImageCatalog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	catalog := &ImageCatalog{}
+	err = json.Unmarshal(data, catalog)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse image catalog %s: %w", path, err)
+	}
+	for i, image := range catalog.Images {
+		if image.Image == "" || image.Config == nil {
+			return nil, fmt.Errorf("image catalog %s: entry %d needs an image and a config", path, i)
+		}
+	}
+	return catalog, nil
+}
+
+// Save writes the catalog to path, sorted so that catalogs can be kept in version control
+func (c *ImageCatalog) Save(path string) error {
+	sort.SliceStable(c.Images, func(i, j int) bool {
+		if c.Images[i].Image != c.Images[j].Image {
+			return c.Images[i].Image < c.Images[j].Image
+		}
+		return c.Images[i].Platform < c.Images[j].Platform
+	})
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Add records the config of image for platform, replacing what the catalog knew about it
+func (c *ImageCatalog) Add(image string, platform string, config *ImageConfig) {
+	if platform == "" {
+		platform = DefaultPlatform
+	}
+	for i, entry := range c.Images {
+		if entry.Image == image && entry.Platform == platform {
+			c.Images[i].Config = config
+			return
+		}
+	}
+	c.Images = append(c.Images, CatalogImage{image, platform, config})
+}
+
+// Find returns the config of the image of lookup. Images match when they name the same reference, e.g. nginx and
+// docker.io/library/nginx:latest, or when lookup is pinned to the digest an entry resolved to.
+func (c *ImageCatalog) Find(lookup ImageLookup) (*ImageConfig, bool) {
+	platform := lookup.Platform
+	if platform == "" {
+		platform = DefaultPlatform
+	}
+	reference := normalizeImage(lookup.Image)
+	_, digest, _ := strings.Cut(lookup.Image, "@")
+
+	var byDigest *ImageConfig
+	for _, entry := range c.Images {
+		if entry.Platform != platform {
+			continue
+		}
+		if normalizeImage(entry.Image) == reference {
+			return entry.Config, true
+		}
+		if digest != "" && entry.Config.Digest == digest && byDigest == nil {
+			byDigest = entry.Config
+		}
+	}
+	return byDigest, byDigest != nil
+}
+
+// normalizeImage spells out the defaults of an image reference, the registry and the latest tag
+func normalizeImage(image string) string {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return image
+	}
+	return ref.Name()
+}
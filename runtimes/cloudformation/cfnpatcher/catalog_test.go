@@ -0,0 +1,78 @@
+package cfnpatcher
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImageCatalog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catalog.json")
+	digest := "sha256:0f3c1e0e3c1f1f26e2c5b1c2b5d6f5e4d3c2b1a0f9e8d7c6b5a4f3e2d1c0b9a8"
+
+	catalog := &ImageCatalog{}
+	catalog.Add("nginx:1.25", "", &ImageConfig{Entrypoint: []string{"/docker-entrypoint.sh"}, Digest: digest})
+	catalog.Add("nginx:1.25", "linux/arm64", &ImageConfig{Entrypoint: []string{"/docker-entrypoint-arm64.sh"}})
+	catalog.Add("alpine", "", &ImageConfig{Command: []string{"/bin/sh"}, User: "root"})
+	require.NoError(t, catalog.Save(path))
+
+	loaded, err := LoadImageCatalog(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"alpine", "nginx:1.25", "nginx:1.25"}, []string{loaded.Images[0].Image, loaded.Images[1].Image, loaded.Images[2].Image})
+
+	tests := []struct {
+		lookup     ImageLookup
+		entrypoint string
+	}{
+		{ImageLookup{"nginx:1.25", DefaultPlatform}, "/docker-entrypoint.sh"},
+		{ImageLookup{"docker.io/library/nginx:1.25", DefaultPlatform}, "/docker-entrypoint.sh"},
+		{ImageLookup{"nginx:1.25", "linux/arm64"}, "/docker-entrypoint-arm64.sh"},
+		{ImageLookup{"mirror.example.com/nginx@" + digest, DefaultPlatform}, "/docker-entrypoint.sh"},
+		{ImageLookup{"nginx:1.26", DefaultPlatform}, ""},
+		{ImageLookup{"alpine", "linux/arm64"}, ""},
+	}
+	for _, tc := range tests {
+		config, found := loaded.Find(tc.lookup)
+		if tc.entrypoint == "" {
+			assert.False(t, found, tc.lookup)
+			continue
+		}
+		if assert.True(t, found, tc.lookup) {
+			assert.Equal(t, []string{tc.entrypoint}, config.Entrypoint, tc.lookup)
+		}
+	}
+	config, found := loaded.Find(ImageLookup{"docker.io/library/alpine:latest", ""})
+	assert.True(t, found)
+	assert.Equal(t, "root", config.User)
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"images": [{"image": "nginx"}]}`), 0o644))
+	_, err = LoadImageCatalog(path)
+	assert.ErrorContains(t, err, "needs an image and a config")
+}
+
+func TestHintCacheCatalog(t *testing.T) {
+	catalog := &ImageCatalog{}
+	catalog.Add("nginx", DefaultPlatform, &ImageConfig{Entrypoint: []string{"/docker-entrypoint.sh"}})
+	lookup := &countingLookup{}
+	ctx := context.Background()
+
+	cache := &HintCache{Lookup: lookup.lookup, Catalog: catalog}
+	config, err := cache.Get(ctx, ImageLookup{"nginx", DefaultPlatform})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/docker-entrypoint.sh"}, config.Entrypoint)
+	assert.Equal(t, 0, lookup.count("nginx"))
+	// images missing from the catalog are looked up in their registry
+	_, err = cache.Get(ctx, ImageLookup{"alpine", DefaultPlatform})
+	require.NoError(t, err)
+	assert.Equal(t, 1, lookup.count("alpine"))
+
+	offline := &HintCache{Lookup: lookup.lookup, Catalog: catalog, Offline: true}
+	_, err = offline.Get(ctx, ImageLookup{"busybox", DefaultPlatform})
+	assert.True(t, errors.Is(err, ErrNotInCatalog))
+	assert.Equal(t, 0, lookup.count("busybox"))
+}
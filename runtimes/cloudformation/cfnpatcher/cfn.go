@@ -2,7 +2,10 @@ package cfnpatcher
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/Jeffail/gabs/v2"
 	"github.com/rs/zerolog/log"
@@ -16,12 +19,66 @@ type Configuration struct {
 	LogGroup           string
 	ParameterizeEnvars bool
 	SidecarConfig      string
+	FailurePolicy      FailurePolicy
+	// SelectionRules are evaluated in order before any tag or label, the first matching rule decides
+	SelectionRules []SelectionRule
+	// Recipes is a catalog of kilt definitions by name, chosen with the kilt-recipe tag or the kilt.recipe label.
+	// Kilt is used when no recipe is chosen, or the DefaultRecipe from the catalog when Kilt is empty.
+	Recipes       map[string]string
+	DefaultRecipe string
+	// SnippetLogicalID names the task definition patched through a snippet level Fn::Transform
+	SnippetLogicalID string
+	// HintCache remembers repository hints across invocations, DefaultHintCache when nil
+	HintCache *HintCache
+	// HintWorkers bounds the concurrent registry lookups of a request, DefaultHintWorkers when 0
+	HintWorkers int
+	// HintTimeout bounds the time a request spends on repository hints, DefaultHintTimeout when 0
+	HintTimeout time.Duration
+	// ImagePinning selects the images replaced by their digest, ImagePinningNone when empty. Digests are resolved
+	// through the HintCache, within HintTimeout.
+	ImagePinning ImagePinning
+	// PinFailurePolicy decides what happens to images whose digest could not be resolved, PinFailureKeepTag when empty
+	PinFailurePolicy PinFailurePolicy
+	// Region and AccountID are the values of the AWS::Region and AWS::AccountId pseudo parameters
+	Region    string
+	AccountID string
+}
+
+// FailurePolicy decides what happens to a task definition that could not be patched
+type FailurePolicy string
+
+const (
+	// FailurePolicySkip leaves the original resource untouched and carries on with the rest of the template
+	FailurePolicySkip FailurePolicy = "skip"
+	// FailurePolicyFail aborts the whole transformation
+	FailurePolicyFail FailurePolicy = "fail"
+	// FailurePolicyKeepPartial keeps whatever was patched before the failure
+	FailurePolicyKeepPartial FailurePolicy = "keep-partial"
+)
+
+var FailurePolicies = []FailurePolicy{FailurePolicySkip, FailurePolicyFail, FailurePolicyKeepPartial}
+
+func ParseFailurePolicy(policy string) (FailurePolicy, error) {
+	if policy == "" {
+		return FailurePolicySkip, nil
+	}
+	for _, v := range FailurePolicies {
+		if FailurePolicy(policy) == v {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("unknown failure policy %q, expected one of %v", policy, FailurePolicies)
 }
 
 type InstrumentationHints struct {
 	IgnoreContainersNamed  []string
 	IncludeContainersNamed []string
 	HasGlobalInclude       bool
+	HasGlobalIgnore        bool
+	LogicalID              string
+	Family                 string
+	Recipe                 string
+	ConfigOverrides        map[string]interface{}
 }
 
 const KiltIgnoreTag = "kilt-ignore"
@@ -31,7 +88,21 @@ const KiltIncludeContainersTag = "kilt-include-containers"
 
 var OptTagKeys = []string{KiltIgnoreTag, KiltIncludeTag, KiltIgnoreContainersTag, KiltIncludeContainersTag}
 
+// DockerLabels on single container definitions, they take precedence over tags and the global OptIn mode
+const KiltIgnoreLabel = "kilt.ignore"
+const KiltIncludeLabel = "kilt.include"
+
+// Labels of images, read from their registry with repository hints. Image owners can tell that an image cannot be
+// instrumented, e.g. a scratch image, or which recipe suits it.
+const KiltIgnoreImageLabel = "io.kilt.ignore"
+const KiltRecipeImageLabel = "io.kilt.recipe"
+
+// isOptTagKey tells whether a tag is read by kilt: the OptTagKeys, but also the recipe and recipe config tags, which
+// opt nothing in or out
 func isOptTagKey(key string) bool {
+	if key == KiltRecipeTag || strings.HasPrefix(key, KiltConfigTagPrefix) {
+		return true
+	}
 	for _, v := range OptTagKeys {
 		if key == v {
 			return true
@@ -59,24 +130,66 @@ func extractContainersFromTag(tags map[string]string, tag string) []string {
 
 func extractHintsFromTags(tags map[string]string) *InstrumentationHints {
 	_, included := tags[KiltIncludeTag]
+	_, ignored := tags[KiltIgnoreTag]
 	return &InstrumentationHints{
 		IgnoreContainersNamed:  extractContainersFromTag(tags, KiltIgnoreContainersTag),
 		IncludeContainersNamed: extractContainersFromTag(tags, KiltIncludeContainersTag),
 		HasGlobalInclude:       included,
+		HasGlobalIgnore:        ignored,
+		Recipe:                 tags[KiltRecipeTag],
+		ConfigOverrides:        tagConfigOverrides(tags),
 	}
 }
 
-func Patch(ctx context.Context, configuration *Configuration, fragment, templateParameters []byte) ([]byte, error) {
+func Patch(ctx context.Context, configuration *Configuration, fragment, templateParameters []byte) (result []byte, err error) {
 	l := log.Ctx(ctx)
+	defer func() {
+		if r := recover(); r != nil {
+			l.Error().Interface("panic", r).Msg("recovered from panic while patching template")
+			result = nil
+			err = fmt.Errorf("unexpected error while patching template: %v", r)
+		}
+	}()
+
 	template, err := gabs.ParseJSON(fragment)
 	if err != nil {
 		l.Error().Err(err).Msg("failed to parse input fragment")
 		return nil, err
 	}
 
+	configuration, err = withCompiledSelectionRules(configuration)
+	if err != nil {
+		l.Error().Err(err).Msg("invalid selection rules")
+		return nil, err
+	}
+
+	snippet := detectSnippet(template)
+	snippetLogicalID := configuration.SnippetLogicalID
+	if snippet != snippetNone {
+		if snippetLogicalID == "" {
+			snippetLogicalID = defaultSnippetLogicalID
+		}
+		l.Info().Str("resource", snippetLogicalID).Msg("patching snippet transform")
+		template, err = wrapSnippet(snippet, template, snippetLogicalID)
+		if err != nil {
+			return nil, err
+		}
+		if configuration.ParameterizeEnvars {
+			l.Warn().Msg("recipe envars cannot be parameterized from a snippet transform, using their values")
+			snippetConfiguration := *configuration
+			snippetConfiguration.ParameterizeEnvars = false
+			configuration = &snippetConfiguration
+		}
+	}
+
 	if configuration.ParameterizeEnvars {
 		l.Info().Msg("parameterizing recipe envars")
-		applyParametersPatch(ctx, template, configuration)
+		// the patched resources refer to these parameters, the template cannot be deployed without them
+		_, err = applyParametersPatch(ctx, template, configuration)
+		if err != nil {
+			l.Error().Err(err).Msg("failed to parameterize recipe envars")
+			return nil, fmt.Errorf("could not parameterize recipe envars: %w", err)
+		}
 	}
 
 	var parameters *gabs.Container
@@ -88,22 +201,133 @@ func Patch(ctx context.Context, configuration *Configuration, fragment, template
 		}
 	}
 
+	type selectedResource struct {
+		name     string
+		resource *gabs.Container
+		hints    *InstrumentationHints
+	}
+	eval := newEvaluator(template, parameters, configuration)
+	failures := make([]*ResourceError, 0)
+	selected := make([]selectedResource, 0)
 	for name, resource := range template.S("Resources").ChildrenMap() {
 		if matchFargate(resource) {
-			optTags := getOptTags(resource)
-			if isIgnored(optTags, configuration.OptIn) {
+			if conditionName, ok := resource.S("Condition").Data().(string); ok {
+				exists, err := eval.condition(conditionName, 0)
+				if err == nil && !exists {
+					l.Info().Str("resource", name).Str("condition", conditionName).Msg("ignored resource due to condition")
+					continue
+				}
+			}
+
+			optTags, err := getOptTags(resource, eval)
+			if err != nil {
+				l.Error().Err(err).Str("resource", name).Msg("could not read opt in/out tags, leaving resource untouched")
+				if configuration.FailurePolicy == FailurePolicyFail {
+					failures = append(failures, newResourceError(name, fmt.Errorf("could not read tags: %w", err)))
+				}
+				continue
+			}
+			hints := extractHintsFromTags(optTags)
+			hints.LogicalID = name
+			hints.Family, _ = eval.resolveString(resource.S("Properties", "Family"))
+
+			ruleIncluded, ruleExcluded := resourceSelection(resource, hints, eval, configuration.SelectionRules)
+			if ruleExcluded {
+				l.Info().Str("resource", name).Msg("ignored resource due to selection rules")
+				continue
+			}
+			if !ruleIncluded && isIgnored(optTags, configuration.OptIn) && !hasLabeledInclude(resource) {
 				l.Info().Str("resource", name).Msg("ignored resource due to tag")
 				continue
 			}
 
-			l.Info().Str("resource", name).Msg("patching task definition")
-			hints := extractHintsFromTags(optTags)
-			_, err = applyTaskDefinitionPatch(ctx, name, resource, parameters, configuration, hints)
+			selected = append(selected, selectedResource{name, resource, hints})
+		}
+	}
+
+	if configuration.UseRepositoryHints || configuration.ImagePinning == ImagePinningAll {
+		resources := make([]*gabs.Container, 0, len(selected))
+		for _, s := range selected {
+			resources = append(resources, s.resource)
+		}
+		prefetchRepositoryHints(ctx, resources, eval, configuration)
+	}
+
+	for _, s := range selected {
+		l.Info().Str("resource", s.name).Msg("patching task definition")
+		err = patchResource(ctx, template, s.name, s.resource, eval, configuration, s.hints)
+		if err != nil {
+			failures = append(failures, newResourceError(s.name, err))
+		}
+	}
+
+	// with FailurePolicyFail every resource is still attempted so that all failures are reported at once
+	if len(failures) > 0 {
+		sort.Slice(failures, func(i, j int) bool {
+			return failures[i].Resource < failures[j].Resource
+		})
+		return nil, &PatchError{Failures: failures}
+	}
+
+	if snippet != snippetNone {
+		return unwrapSnippet(snippet, template, snippetLogicalID)
+	}
+	return template.Bytes(), nil
+}
+
+// patchResource patches a copy of the task definition and swaps it into the template only when patching succeeds,
+// so that a failure halfway through never leaves a half rewritten resource behind unless explicitly requested
+func patchResource(ctx context.Context, template *gabs.Container, name string, resource *gabs.Container, eval *evaluator, configuration *Configuration, hints *InstrumentationHints) error {
+	l := log.Ctx(ctx)
+
+	working, err := gabs.ParseJSON(resource.Bytes())
+	if err != nil {
+		return fmt.Errorf("could not copy resource: %w", err)
+	}
+
+	conditions, err := applyTaskDefinitionPatchSafely(ctx, name, working, eval, configuration, hints)
+	if err == nil {
+		_, err = template.Set(working.Data(), "Resources", name)
+		if err != nil {
+			return fmt.Errorf("could not replace resource: %w", err)
+		}
+		for conditionName, condition := range conditions {
+			_, err = template.Set(condition, "Conditions", conditionName)
 			if err != nil {
-				l.Error().Err(err).Str("resource", name).Msgf("could not patch resource")
+				return fmt.Errorf("could not add condition %s: %w", conditionName, err)
 			}
 		}
+		return nil
 	}
 
-	return template.Bytes(), nil
+	switch configuration.FailurePolicy {
+	case FailurePolicyFail:
+		l.Error().Err(err).Str("resource", name).Msg("could not patch resource, aborting")
+		return err
+	case FailurePolicyKeepPartial:
+		if flattenContainerDefinitions(resource, eval).isConditional() {
+			// the Fn::If around the containers are only restored once patching succeeds
+			l.Error().Err(err).Str("resource", name).Msg("could not patch resource, keeping original resource since its container definitions are conditional")
+			break
+		}
+		l.Error().Err(err).Str("resource", name).Msg("could not patch resource, keeping partially patched resource")
+		_, err = template.Set(working.Data(), "Resources", name)
+		if err != nil {
+			return fmt.Errorf("could not replace resource: %w", err)
+		}
+	default:
+		l.Error().Err(err).Str("resource", name).Msg("could not patch resource, keeping original resource")
+	}
+	return nil
+}
+
+// applyTaskDefinitionPatchSafely turns panics raised while patching a single resource into errors, so they are subject
+// to the failure policy like any other error instead of taking down the whole invocation
+func applyTaskDefinitionPatchSafely(ctx context.Context, name string, resource *gabs.Container, eval *evaluator, configuration *Configuration, hints *InstrumentationHints) (conditions map[string]interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unexpected error: %v", r)
+		}
+	}()
+	return applyTaskDefinitionPatch(ctx, name, resource, eval, configuration, hints)
 }
@@ -2,11 +2,15 @@ package cfnpatcher
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/Jeffail/gabs/v2"
@@ -24,14 +28,23 @@ var optInTests = [...]string{
 	"respect_ignores/opt_in_single_container",
 }
 
-var optPanicTests = [...]string{
-	"respect_ignores/panic_opt_exclude",
-	"respect_ignores/panic_opt_exclude_container",
-	"respect_ignores/panic_opt_include",
-	"respect_ignores/panic_opt_include_container",
+var optIntrinsicTests = [...]string{
+	"respect_ignores/intrinsic_opt_exclude",
+	"respect_ignores/intrinsic_opt_exclude_container",
+	"respect_ignores/intrinsic_opt_include",
+	"respect_ignores/intrinsic_opt_include_container",
+	"respect_ignores/intrinsic_opt_include_if",
+	"respect_ignores/intrinsic_opt_include_if_disabled",
+	"respect_ignores/intrinsic_opt_include_unresolvable",
+}
+
+var optInLabelTests = [...]string{
+	"docker_labels/opt_in_label",
 }
 
 var defaultTests = [...]string{
+	"docker_labels/opt_out_label",
+
 	"respect_ignores/opt_out_default",
 	"respect_ignores/opt_out_ignored",
 	"respect_ignores/opt_out_ignore_multiple_containers",
@@ -47,6 +60,12 @@ var defaultTests = [...]string{
 	"patching/volumes_from",
 }
 
+var conditionsTests = [...]string{
+	"conditions/container_if_known",
+	"conditions/container_if_unknown",
+	"conditions/resource_condition",
+}
+
 var enableHints = [...]string{
 	"patching/hints_no_overrides",
 	"patching/hints_override_command",
@@ -142,6 +161,55 @@ task {
 }
 `
 
+const lightRecipeConfig = `
+build {
+	entry_point: ["/light/run", "--"]
+	command: [] ${?original.entry_point} ${?original.command}
+	mount: [
+		{
+			name: "KiltLight"
+			image: "KILT:light"
+			volumes: ["/light"]
+			entry_point: ["/light/wait"]
+		}
+	]
+}
+`
+
+const fullRecipeConfig = `
+build {
+	entry_point: ["/full/run", "--"]
+	command: [] ${?original.entry_point} ${?original.command}
+	mount: [
+		{
+			name: "KiltFull"
+			image: "KILT:full"
+			volumes: ["/full"]
+			entry_point: ["/full/wait"]
+		}
+	]
+}
+`
+
+const recipeConfigOverridesConfig = `
+build {
+	entry_point: ["/kilt/run", "--"]
+	command: [] ${?original.entry_point} ${?original.command}
+	environment_variables: {
+		"KILT_COLLECTOR": ${config.collector.host}":"${config.collector.port}
+		"KILT_SAMPLING": ${config.sampling}
+	}
+	mount: [
+		{
+			name: "KiltImage"
+			image: "KILT:latest"
+			volumes: ["/kilt"]
+			entry_point: ["/kilt/wait"]
+		}
+	]
+}
+`
+
 func runTest(t *testing.T, name string, context context.Context, config Configuration) {
 	fragment, err := ioutil.ReadFile("fixtures/" + name + ".json")
 	if err != nil {
@@ -196,6 +264,22 @@ func TestPatchingOptIn(t *testing.T) {
 	}
 }
 
+func TestPatchingOptInLabels(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+
+	for _, testName := range optInLabelTests {
+		t.Run(testName, func(t *testing.T) {
+			runTest(t, testName, l.WithContext(context.Background()),
+				Configuration{
+					Kilt:               defaultConfig,
+					OptIn:              true,
+					RecipeConfig:       "{}",
+					UseRepositoryHints: false,
+				})
+		})
+	}
+}
+
 func TestPatching(t *testing.T) {
 	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
 
@@ -212,6 +296,186 @@ func TestPatching(t *testing.T) {
 	}
 }
 
+func TestPatchingConditions(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+
+	for _, testName := range conditionsTests {
+		t.Run(testName, func(t *testing.T) {
+			runTest(t, testName, l.WithContext(context.Background()),
+				Configuration{
+					Kilt:               defaultConfig,
+					OptIn:              false,
+					RecipeConfig:       "{}",
+					UseRepositoryHints: false,
+				})
+		})
+	}
+}
+
+func TestPatchingSelectionRules(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+
+	rules, err := ParseSelectionRules(`[
+		{"action": "exclude", "logicalId": "Canary*"},
+		{"action": "exclude", "image": "*.dkr.ecr.*/legacy/*"},
+		{"action": "exclude", "family": "/^batch-/"},
+		{"action": "include", "image": "123456789012.dkr.ecr.*"}
+	]`)
+	assert.NoError(t, err)
+
+	runTest(t, "selection/rules", l.WithContext(context.Background()),
+		Configuration{
+			Kilt:               defaultConfig,
+			OptIn:              true,
+			RecipeConfig:       "{}",
+			UseRepositoryHints: false,
+			SelectionRules:     rules,
+		})
+}
+
+func TestPatchingRecipeCatalog(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+
+	runTest(t, "recipes/catalog", l.WithContext(context.Background()),
+		Configuration{
+			Kilt:               defaultConfig,
+			OptIn:              false,
+			RecipeConfig:       "{}",
+			UseRepositoryHints: false,
+			Recipes: map[string]string{
+				"full":  defaultConfig,
+				"light": lightRecipeConfig,
+			},
+			DefaultRecipe: "full",
+		})
+}
+
+func TestPatchingSnippets(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+
+	runTest(t, "snippet/resource", l.WithContext(context.Background()),
+		Configuration{
+			Kilt:               defaultConfig,
+			OptIn:              false,
+			RecipeConfig:       "{}",
+			UseRepositoryHints: false,
+		})
+
+	configuration := Configuration{
+		Kilt:               defaultConfig,
+		OptIn:              false,
+		RecipeConfig:       "{}",
+		UseRepositoryHints: false,
+		Recipes: map[string]string{
+			"light": lightRecipeConfig,
+		},
+	}
+	err := configuration.ApplyTransformParameters([]byte(`{"Recipe": "light", "LogicalId": "WebTask"}`))
+	assert.NoError(t, err)
+	runTest(t, "snippet/properties", l.WithContext(context.Background()), configuration)
+}
+
+func TestPatchingExplicitDefaultRecipe(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+
+	// naming the default recipe picks it from the catalog, only containers without a recipe get the definition
+	runTest(t, "recipes/explicit_default", l.WithContext(context.Background()),
+		Configuration{
+			Kilt:               defaultConfig,
+			OptIn:              false,
+			RecipeConfig:       "{}",
+			UseRepositoryHints: false,
+			Recipes: map[string]string{
+				"full":  fullRecipeConfig,
+				"light": lightRecipeConfig,
+			},
+			DefaultRecipe: "full",
+		})
+}
+
+func TestApplyTransformParameters(t *testing.T) {
+	configuration := Configuration{
+		Kilt:         defaultConfig,
+		RecipeConfig: `{"collector": {"host": "global.example.com", "port": "6443"}}`,
+		Recipes: map[string]string{
+			"light": lightRecipeConfig,
+		},
+	}
+
+	err := configuration.ApplyTransformParameters(nil)
+	assert.NoError(t, err)
+
+	err = configuration.ApplyTransformParameters([]byte(`{"OptIn": "true", "Recipe": "light", "Config": "{\"collector\": {\"host\": \"team.example.com\"}}"}`))
+	assert.NoError(t, err)
+	assert.True(t, configuration.OptIn)
+	assert.Equal(t, lightRecipeConfig, configuration.Kilt)
+	assert.Equal(t, "light", configuration.DefaultRecipe)
+	assert.JSONEq(t, `{"collector": {"host": "team.example.com", "port": "6443"}}`, configuration.RecipeConfig)
+
+	err = configuration.ApplyTransformParameters([]byte(`{"OptIn": "maybe", "Recipe": "heavy", "Flavour": "x"}`))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "OptIn")
+	assert.Contains(t, err.Error(), "Recipe")
+	assert.Contains(t, err.Error(), "Flavour")
+}
+
+func TestPatchingRecipeConfigOverrides(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+
+	runTest(t, "recipe_config/overrides", l.WithContext(context.Background()),
+		Configuration{
+			Kilt:               recipeConfigOverridesConfig,
+			OptIn:              false,
+			RecipeConfig:       `{"collector": {"host": "global.example.com", "port": "6443"}, "sampling": "1"}`,
+			UseRepositoryHints: false,
+		})
+}
+
+func TestMergeRecipeConfig(t *testing.T) {
+	global := `{"collector": {"host": "global.example.com", "port": "6443"}, "sampling": "1"}`
+
+	merged, err := mergeRecipeConfig(global)
+	assert.NoError(t, err)
+	assert.Equal(t, global, merged, "global config should be untouched without overrides")
+
+	merged, err = mergeRecipeConfig(global,
+		map[string]interface{}{"sampling": "0.5"},
+		tagConfigOverrides(map[string]string{"kilt-config-collector.host": "team.example.com", "kilt-ignore": "x"}),
+	)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"collector": {"host": "team.example.com", "port": "6443"}, "sampling": "0.5"}`, merged)
+
+	_, err = mergeRecipeConfig("collector.host = global", map[string]interface{}{"sampling": "0.5"})
+	assert.Error(t, err)
+}
+
+func TestSidecarNames(t *testing.T) {
+	parse := func(definition string) interface{} {
+		var sidecar interface{}
+		assert.NoError(t, json.Unmarshal([]byte(definition), &sidecar))
+		return sidecar
+	}
+	injected := map[string][]sidecarVariant{
+		"agent":  {{"agent", `{"Image":"agent","Name":"agent"}`}},
+		"helper": {{"helper", `{"DependsOn":[{"ContainerName":"agent"}],"Image":"helper","Name":"helper"}`}},
+	}
+
+	// helper is the same as before, but depends on an agent that is not
+	renamed, err := sidecarNames([]interface{}{
+		parse(`{"Name": "helper", "Image": "helper", "DependsOn": [{"ContainerName": "agent"}]}`),
+		parse(`{"Name": "agent", "Image": "agent", "Environment": [{"Name": "KILT_SAMPLING", "Value": "0.1"}]}`),
+	}, injected)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"agent": "agent-2", "helper": "helper-2"}, renamed)
+
+	renamed, err = sidecarNames([]interface{}{
+		parse(`{"Name": "helper", "Image": "helper", "DependsOn": [{"ContainerName": "agent"}]}`),
+		parse(`{"Name": "agent", "Image": "agent"}`),
+	}, injected)
+	assert.NoError(t, err)
+	assert.Empty(t, renamed)
+}
+
 func TestPatchingWithRepoHints(t *testing.T) {
 	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
 
@@ -223,11 +487,198 @@ func TestPatchingWithRepoHints(t *testing.T) {
 					OptIn:              false,
 					RecipeConfig:       "{}",
 					UseRepositoryHints: true,
+					HintCache:          &HintCache{Lookup: nginxConfig},
+				})
+		})
+	}
+}
+
+func TestPatchingWithImageCatalog(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+	nginx, _ := nginxConfig(context.Background(), ImageLookup{"nginx", DefaultPlatform})
+	catalog := &ImageCatalog{}
+	catalog.Add("docker.io/library/nginx:latest", DefaultPlatform, nginx)
+
+	// the catalog answers like the registry, without any lookup
+	for _, testName := range enableHints {
+		t.Run(testName, func(t *testing.T) {
+			runTest(t, testName, l.WithContext(context.Background()),
+				Configuration{
+					Kilt:               defaultConfig,
+					OptIn:              false,
+					RecipeConfig:       "{}",
+					UseRepositoryHints: true,
+					HintCache:          &HintCache{Catalog: catalog, Offline: true},
 				})
 		})
 	}
 }
 
+func TestPatchingImageLabels(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+
+	labels := map[string]map[string]string{
+		"static:1.0":  {KiltIgnoreImageLabel: "true"},
+		"enabled:1.0": {KiltIgnoreImageLabel: "false"},
+		"java-app:2":  {KiltRecipeImageLabel: "light"},
+		"vendor:3.1":  {KiltRecipeImageLabel: "vendor-recipe"},
+	}
+	runTest(t, "image_labels/labels", l.WithContext(context.Background()),
+		Configuration{
+			Kilt:               defaultConfig,
+			OptIn:              false,
+			RecipeConfig:       "{}",
+			UseRepositoryHints: true,
+			Recipes: map[string]string{
+				"full":  defaultConfig,
+				"light": lightRecipeConfig,
+			},
+			HintCache: &HintCache{Lookup: func(ctx context.Context, lookup ImageLookup) (*ImageConfig, error) {
+				if lookup.Image == "nginx" {
+					return nginxConfig(ctx, lookup)
+				}
+				return &ImageConfig{Labels: labels[lookup.Image]}, nil
+			}},
+		})
+}
+
+func TestPatchingRepoHintsPlatform(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+
+	runTest(t, "patching/hints_runtime_platform", l.WithContext(context.Background()),
+		Configuration{
+			Kilt:               defaultConfig,
+			OptIn:              false,
+			RecipeConfig:       "{}",
+			UseRepositoryHints: true,
+			HintCache: &HintCache{Lookup: func(_ context.Context, lookup ImageLookup) (*ImageConfig, error) {
+				return &ImageConfig{Entrypoint: []string{"/entrypoint-" + lookup.Platform}, Platform: lookup.Platform}, nil
+			}},
+		})
+}
+
+const imageConfigConfig = `
+build {
+	entry_point: ["/kilt/run", "--"]
+	command: [] ${?original.entry_point} ${?original.command}
+	environment_variables: {
+		"KILT_ORIGINAL_PATH": ${?original.image_config.env.PATH}
+		"KILT_ORIGINAL_USER": ${?original.image_config.user}
+		"KILT_ORIGINAL_WORKDIR": ${?original.image_config.working_dir}
+		"KILT_ORIGINAL_VERSION": ${?original.image_config.labels.org_opencontainers_image_version}
+	}
+}
+`
+
+func TestPatchingImageConfig(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+
+	configs := map[string]*ImageConfig{
+		"nginx": {
+			Entrypoint: []string{"/docker-entrypoint.sh"},
+			Command:    []string{"nginx", "-g", "daemon off;"},
+			Env:        []string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "NGINX_VERSION=1.25.4"},
+			User:       "nginx",
+			WorkingDir: "/usr/share/nginx/html",
+			Labels:     map[string]string{"org.opencontainers.image.version": "1.25.4"},
+		},
+		"worker:1.0": {
+			Env:        []string{"PATH=/opt/worker/bin:/usr/bin:/bin"},
+			WorkingDir: "/opt/worker",
+		},
+	}
+	runTest(t, "image_config/wrap", l.WithContext(context.Background()),
+		Configuration{
+			Kilt:               imageConfigConfig,
+			OptIn:              false,
+			RecipeConfig:       "{}",
+			UseRepositoryHints: true,
+			HintCache: &HintCache{Lookup: func(_ context.Context, lookup ImageLookup) (*ImageConfig, error) {
+				return configs[lookup.Image], nil
+			}},
+		})
+}
+
+const imagePinningConfig = `
+build {
+	entry_point: ["/kilt/run", "--"]
+	command: [] ${?original.entry_point} ${?original.command}
+	mount: [
+		{
+			name: "KiltImage"
+			image: "quay.io/sysdig/kilt:1.2"
+			volumes: ["/kilt"]
+			entry_point: ["/kilt/wait"]
+		}
+	]
+}
+`
+
+// resolveDigest reports a digest derived from the image reference, as if every image had been pushed once
+func resolveDigest(_ context.Context, image string) (string, error) {
+	if strings.HasPrefix(image, "unknown.example.com/") {
+		return "", errors.New("MANIFEST_UNKNOWN: manifest unknown")
+	}
+	sum := sha256.Sum256([]byte(image))
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+func TestPatchingImagePinning(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+
+	for _, pinning := range []ImagePinning{ImagePinningSidecars, ImagePinningAll} {
+		runTest(t, "image_pinning/"+string(pinning), l.WithContext(context.Background()),
+			Configuration{
+				Kilt:         imagePinningConfig,
+				OptIn:        false,
+				RecipeConfig: "{}",
+				HintCache:    &HintCache{ResolveDigest: resolveDigest},
+				ImagePinning: pinning,
+			})
+	}
+}
+
+func TestImagePinningFailure(t *testing.T) {
+	fragment := []byte(`{"Resources": {"taskdef": {"Type": "AWS::ECS::TaskDefinition", "Properties": {
+		"RequiresCompatibilities": ["FARGATE"],
+		"ContainerDefinitions": [{"Name": "app", "Image": "unknown.example.com/app:1.0", "EntryPoint": ["/app"]}]
+	}}}}`)
+	configuration := &Configuration{
+		Kilt:          imagePinningConfig,
+		RecipeConfig:  "{}",
+		HintCache:     &HintCache{ResolveDigest: resolveDigest},
+		ImagePinning:  ImagePinningAll,
+		FailurePolicy: FailurePolicyFail,
+	}
+
+	result, err := Patch(context.Background(), configuration, fragment, make([]byte, 0))
+	assert.NoError(t, err)
+	patched, err := gabs.ParseJSON(result)
+	assert.NoError(t, err)
+	containers := patched.S("Resources", "taskdef", "Properties", "ContainerDefinitions")
+	assert.Equal(t, "unknown.example.com/app:1.0", containers.S("0", "Image").Data())
+	assert.False(t, containers.Exists("0", "DockerLabels", KiltOriginalImageLabel))
+	assert.Contains(t, containers.S("1", "Image").Data(), "quay.io/sysdig/kilt@sha256:")
+
+	configuration.PinFailurePolicy = PinFailureFail
+	_, err = Patch(context.Background(), configuration, fragment, make([]byte, 0))
+	var patchErr *PatchError
+	assert.ErrorAs(t, err, &patchErr)
+	assert.Equal(t, []string{"app"}, patchErr.Failures[0].Containers)
+	assert.ErrorContains(t, err, "could not pin image: MANIFEST_UNKNOWN")
+}
+
+// nginxConfig answers repository hints like the registry does for the nginx image
+func nginxConfig(_ context.Context, lookup ImageLookup) (*ImageConfig, error) {
+	if lookup.Image != "nginx" || lookup.Platform != DefaultPlatform {
+		return nil, fmt.Errorf("unknown image %s for %s", lookup.Image, lookup.Platform)
+	}
+	return &ImageConfig{
+		Entrypoint: []string{"/docker-entrypoint.sh"},
+		Command:    []string{"nginx", "-g", "daemon off;"},
+	}, nil
+}
+
 func TestPatchingSidecarEnv(t *testing.T) {
 	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
 
@@ -290,6 +741,20 @@ func TestPatchingForParameterizingEnvars(t *testing.T) {
 	}
 }
 
+func TestParameterizeEnvarsUnknownDefaultRecipe(t *testing.T) {
+	fragment, err := ioutil.ReadFile("fixtures/" + parameterizedEnvarsTests[0] + ".json")
+	assert.NoError(t, err)
+
+	configuration := &Configuration{
+		DefaultRecipe:      "missing",
+		Recipes:            map[string]string{"light": lightRecipeConfig},
+		RecipeConfig:       "{}",
+		ParameterizeEnvars: true,
+	}
+	_, err = Patch(context.Background(), configuration, fragment, make([]byte, 0))
+	assert.ErrorContains(t, err, "could not parameterize recipe envars: unknown recipe missing")
+}
+
 func TestPatchingForLogGroup(t *testing.T) {
 	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
 
@@ -325,13 +790,11 @@ func TestPatchingForLogGroup(t *testing.T) {
 	}
 }
 
-func TestOptTagPanic(t *testing.T) {
+func TestOptTagIntrinsics(t *testing.T) {
 	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
 
-	for _, testName := range optPanicTests {
+	for _, testName := range optIntrinsicTests {
 		t.Run(testName, func(t *testing.T) {
-			defer func() { recover() }()
-
 			runTest(t, testName, l.WithContext(context.Background()),
 				Configuration{
 					Kilt:               defaultConfig,
@@ -364,6 +827,10 @@ func TestIsFuncOptKey(t *testing.T) {
 			"kilt-include-containers",
 			true,
 		},
+		{
+			"kilt-recipe",
+			true,
+		},
 		{
 			"so-long-and-thanks-for-all-the-fish",
 			false,
@@ -463,6 +930,26 @@ func TestGetOptTags(t *testing.T) {
 				"kilt-include-containers": "accioContainer",
 			},
 		},
+		{
+			name: `unresolvable-unrelated-tags`,
+			json: `{
+"Properties": {
+	"Tags":[
+		{
+			"Key": "Team",
+			"Value": {"Fn::If": ["UnknownCondition", "a", "b"]}
+		},
+		{"Fn::If": ["UnknownCondition", {"Key": "Stage", "Value": "prod"}, {"Ref": "AWS::NoValue"}]},
+		{
+			"Key": "kilt-ignore",
+			"Value": "true"
+		}
+	]}
+}`,
+			expected: map[string]string{
+				"kilt-ignore": "true",
+			},
+		},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -470,7 +957,8 @@ func TestGetOptTags(t *testing.T) {
 			if err != nil {
 				panic(err)
 			}
-			mm := getOptTags(jsonParsed)
+			mm, err := getOptTags(jsonParsed, newEvaluator(jsonParsed, nil, &Configuration{}))
+			assert.NoError(t, err)
 			eq := reflect.DeepEqual(tc.expected, mm)
 			if !eq {
 				assert.Fail(t, "maps do not match")
@@ -478,3 +966,78 @@ func TestGetOptTags(t *testing.T) {
 		})
 	}
 }
+
+func TestFailurePolicy(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+	fragment, err := ioutil.ReadFile("fixtures/failure_policy/second_container.json")
+	if err != nil {
+		t.Fatalf("cannot find fixtures/failure_policy/second_container.json")
+	}
+	original, _ := gabs.ParseJSON(fragment)
+
+	tests := []struct {
+		policy            FailurePolicy
+		expectError       bool
+		expectedFirstApp  string
+		expectedContainer int
+	}{
+		{FailurePolicySkip, false, "/bin/sh", 2},
+		{"", false, "/bin/sh", 2},
+		{FailurePolicyFail, true, "", 0},
+		{FailurePolicyKeepPartial, false, "/kilt/run", 2},
+	}
+	for _, tc := range tests {
+		t.Run(string(tc.policy), func(t *testing.T) {
+			result, err := Patch(l.WithContext(context.Background()),
+				&Configuration{
+					Kilt:          defaultConfig,
+					RecipeConfig:  "{}",
+					FailurePolicy: tc.policy,
+				}, fragment, make([]byte, 0))
+			if tc.expectError {
+				var patchErr *PatchError
+				assert.ErrorAs(t, err, &patchErr)
+				assert.Len(t, patchErr.Failures, 1)
+				assert.Equal(t, "brokentask", patchErr.Failures[0].Resource)
+				assert.Equal(t, []string{"broken"}, patchErr.Failures[0].Containers)
+				assert.Contains(t, err.Error(), "brokentask (containers broken)")
+				return
+			}
+			assert.NoError(t, err)
+
+			patched, err := gabs.ParseJSON(result)
+			assert.NoError(t, err)
+
+			broken := patched.S("Resources", "brokentask", "Properties", "ContainerDefinitions")
+			assert.Len(t, broken.Children(), tc.expectedContainer)
+			assert.Equal(t, tc.expectedFirstApp, broken.S("0", "EntryPoint", "0").Data())
+			if tc.policy != FailurePolicyKeepPartial {
+				assert.Equal(t, original.S("Resources", "brokentask").String(), patched.S("Resources", "brokentask").String())
+			}
+
+			good := patched.S("Resources", "goodtask", "Properties", "ContainerDefinitions")
+			assert.Len(t, good.Children(), 2, "other resources should still be patched")
+		})
+	}
+}
+
+func TestFailurePolicyKeepPartialConditional(t *testing.T) {
+	l := log.Output(zerolog.ConsoleWriter{Out: os.Stderr}).With().Caller().Logger()
+
+	// a partially patched resource would lose the Fn::If around its containers, the original is kept instead
+	runTest(t, "failure_policy/keep_partial_conditional", l.WithContext(context.Background()),
+		Configuration{
+			Kilt:          defaultConfig,
+			RecipeConfig:  "{}",
+			FailurePolicy: FailurePolicyKeepPartial,
+		})
+}
+
+func TestParseFailurePolicy(t *testing.T) {
+	for _, policy := range []string{"", "skip", "fail", "keep-partial"} {
+		_, err := ParseFailurePolicy(policy)
+		assert.NoError(t, err, policy)
+	}
+	_, err := ParseFailurePolicy("rollback")
+	assert.Error(t, err)
+}
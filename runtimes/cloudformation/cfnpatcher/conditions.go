@@ -0,0 +1,214 @@
+package cfnpatcher
+
+import (
+	"encoding/json"
+	"regexp"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+// maxOrConditions is the maximum number of conditions CloudFormation accepts in Fn::Or
+const maxOrConditions = 10
+
+var nonAlphanumeric = regexp.MustCompile(`[^a-zA-Z0-9]`)
+
+// conditionalContainers tracks container definitions nested in Fn::If so that they can be patched like any other
+// container definition while the conditional structure of the template is kept intact
+type conditionalContainers struct {
+	original   []interface{}
+	containers []interface{}
+	// conditions holds, for every entry of containers, the condition under which it exists or nil if it always does
+	conditions []interface{}
+}
+
+// flattenContainerDefinitions collects container definitions, including the branches of Fn::If that hold one.
+// Conditions that can be evaluated select the branch, otherwise both branches are collected.
+func flattenContainerDefinitions(resource *gabs.Container, eval *evaluator) *conditionalContainers {
+	c := &conditionalContainers{}
+	original, ok := containerDefinitionsData(resource)
+	if !ok {
+		return c
+	}
+	c.original = original
+
+	for _, item := range original {
+		args, isIf := fnIfArgs(item)
+		if !isIf {
+			if _, isMap := item.(map[string]interface{}); isMap {
+				c.containers = append(c.containers, item)
+				c.conditions = append(c.conditions, nil)
+			}
+			continue
+		}
+
+		// the branch not taken is left alone when the condition is known, the sidecars still carry the condition so
+		// that the template stays correct whatever the parameters end up being
+		name := args[0].(string)
+		result, err := eval.condition(name, 0)
+		known := err == nil
+		if (!known || result) && isContainerDefinition(args[1]) {
+			c.containers = append(c.containers, args[1])
+			c.conditions = append(c.conditions, map[string]interface{}{"Condition": name})
+		}
+		if (!known || !result) && isContainerDefinition(args[2]) {
+			c.containers = append(c.containers, args[2])
+			c.conditions = append(c.conditions, negateCondition(name))
+		}
+	}
+	return c
+}
+
+// isConditional reports whether any container definition is wrapped in Fn::If
+func (c *conditionalContainers) isConditional() bool {
+	for _, item := range c.original {
+		if _, isIf := fnIfArgs(item); isIf {
+			return true
+		}
+	}
+	return false
+}
+
+// restore puts the original, now patched, container definitions back in place and appends the sidecars that were
+// injected, wrapped in Fn::If when they are only needed by conditional containers. The returned map holds the
+// conditions that have to be added to the template.
+func (c *conditionalContainers) restore(resource *gabs.Container, resourceName string, patched []bool) (map[string]interface{}, error) {
+	result, ok := containerDefinitionsData(resource)
+	if !ok || len(result) < len(c.containers) {
+		return nil, nil
+	}
+	sidecars := result[len(c.containers):]
+
+	conditionName, negated, expression := c.sidecarCondition(resourceName, patched)
+	noValue := map[string]interface{}{"Ref": "AWS::NoValue"}
+	definitions := append(make([]interface{}, 0, len(c.original)+len(sidecars)), c.original...)
+	for _, sidecar := range sidecars {
+		switch {
+		case conditionName == "":
+			definitions = append(definitions, sidecar)
+		case negated:
+			definitions = append(definitions, map[string]interface{}{
+				"Fn::If": []interface{}{conditionName, noValue, sidecar},
+			})
+		default:
+			definitions = append(definitions, map[string]interface{}{
+				"Fn::If": []interface{}{conditionName, sidecar, noValue},
+			})
+		}
+	}
+
+	_, err := resource.Set(definitions, "Properties", "ContainerDefinitions")
+	if err != nil {
+		return nil, err
+	}
+	if expression == nil {
+		return nil, nil
+	}
+	return map[string]interface{}{conditionName: expression}, nil
+}
+
+// sidecarCondition computes the condition under which injected sidecars are needed. It returns an empty name when
+// sidecars are always needed and a non nil expression when a new condition has to be declared.
+func (c *conditionalContainers) sidecarCondition(resourceName string, patched []bool) (name string, negated bool, expression interface{}) {
+	seen := make(map[string]bool)
+	conditions := make([]interface{}, 0)
+	for i, condition := range c.conditions {
+		if i >= len(patched) || !patched[i] {
+			continue
+		}
+		if condition == nil {
+			return "", false, nil
+		}
+		key, _ := json.Marshal(condition)
+		if !seen[string(key)] {
+			seen[string(key)] = true
+			conditions = append(conditions, condition)
+		}
+	}
+
+	if len(conditions) == 0 {
+		return "", false, nil
+	}
+	// both branches of the same Fn::If were patched, one of them always exists
+	for _, condition := range conditions {
+		if name, ok := conditionName(condition); ok {
+			negation, _ := json.Marshal(negateCondition(name))
+			if seen[string(negation)] {
+				return "", false, nil
+			}
+		}
+	}
+	if len(conditions) == 1 {
+		if name, ok := conditionName(conditions[0]); ok {
+			return name, false, nil
+		}
+		if name, ok := negatedConditionName(conditions[0]); ok {
+			return name, true, nil
+		}
+	}
+	if len(conditions) > maxOrConditions {
+		return "", false, nil
+	}
+
+	return nonAlphanumeric.ReplaceAllString(resourceName, "") + "KiltSidecars", false, map[string]interface{}{"Fn::Or": conditions}
+}
+
+func negateCondition(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"Fn::Not": []interface{}{map[string]interface{}{"Condition": name}},
+	}
+}
+
+func conditionName(condition interface{}) (string, bool) {
+	m, ok := condition.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	name, ok := m["Condition"].(string)
+	return name, ok
+}
+
+func negatedConditionName(condition interface{}) (string, bool) {
+	m, ok := condition.(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	args, ok := m["Fn::Not"].([]interface{})
+	if !ok || len(args) != 1 {
+		return "", false
+	}
+	return conditionName(args[0])
+}
+
+func containerDefinitionsData(resource *gabs.Container) ([]interface{}, bool) {
+	data := resource.S("Properties", "ContainerDefinitions").Data()
+	if c, ok := data.(*gabs.Container); ok {
+		data = c.Data()
+	}
+	list, ok := data.([]interface{})
+	return list, ok
+}
+
+func fnIfArgs(item interface{}) ([]interface{}, bool) {
+	m, ok := item.(map[string]interface{})
+	if !ok || len(m) != 1 {
+		return nil, false
+	}
+	args, ok := m["Fn::If"].([]interface{})
+	if !ok || len(args) != 3 {
+		return nil, false
+	}
+	if _, ok := args[0].(string); !ok {
+		return nil, false
+	}
+	return args, true
+}
+
+func isContainerDefinition(item interface{}) bool {
+	m, ok := item.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, hasRef := m["Ref"]
+	_, isIf := fnIfArgs(item)
+	return !hasRef && !isIf
+}
@@ -1,44 +1,131 @@
 package cfnpatcher
 
 import (
+	"context"
 	"fmt"
+	"sort"
+	"strings"
 
-	"github.com/Jeffail/gabs/v2"
-	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 )
 
-type PartialImageConfig struct {
-	Entrypoint []string
-	Command []string
+// ImageConfig is what repository hints know about an image, from the config stored in its registry
+type ImageConfig struct {
+	Entrypoint []string `json:"entrypoint,omitempty"`
+	Command    []string `json:"command,omitempty"`
+	// Env holds NAME=value pairs, in the order of the image config
+	Env        []string          `json:"env,omitempty"`
+	WorkingDir string            `json:"workingDir,omitempty"`
+	User       string            `json:"user,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	// ExposedPorts are sorted, e.g. 80/tcp
+	ExposedPorts []string `json:"exposedPorts,omitempty"`
+	// Platform is the os/architecture of the image config, e.g. linux/arm64/v8
+	Platform string `json:"platform,omitempty"`
+	// Digest is what the image reference resolved to, the digest of the index for multi-platform images
+	Digest string `json:"digest,omitempty"`
 }
 
-func GetConfigFromRepository(image string) (*PartialImageConfig,error) {
-	ic := new(PartialImageConfig)
+// PartialImageConfig is the former name of ImageConfig
+type PartialImageConfig = ImageConfig
 
-	res, err := crane.Config(image)
+func GetConfigFromRepository(image string) (*ImageConfig, error) {
+	return FetchImageConfig(context.Background(), image, DefaultPlatform, nil)
+}
+
+// FetchImageConfig retrieves the config of image from its registry, giving up when ctx is done. The config of
+// platform, DefaultPlatform when empty, is picked from multi-platform images. keychain authenticates against the
+// registry, authn.DefaultKeychain when nil.
+func FetchImageConfig(ctx context.Context, image string, platform string, keychain authn.Keychain) (*ImageConfig, error) {
+	if platform == "" {
+		platform = DefaultPlatform
+	}
+	p, err := v1.ParsePlatform(platform)
+	if err != nil {
+		return nil, fmt.Errorf("invalid platform %s: %w", platform, err)
+	}
+	if keychain == nil {
+		keychain = authn.DefaultKeychain
+	}
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image %s: %w", image, err)
+	}
+	// the manifest is read once, the image of platform and its config are then retrieved by digest so that a tag
+	// moving in between cannot mix up two images
+	desc, err := remote.Get(ref, remote.WithContext(ctx), remote.WithAuthFromKeychain(keychain), remote.WithPlatform(*p))
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve image %s: %w", image, err)
+	}
+	img, err := desc.Image()
 	if err != nil {
 		return nil, fmt.Errorf("could not get defaults about image %s: %w", image, err)
 	}
-	cont, err := gabs.ParseJSON(res)
+	cf, err := img.ConfigFile()
 	if err != nil {
-		return nil, fmt.Errorf("could not parse response from registry for image %s: %w", image, err)
+		return nil, fmt.Errorf("could not get defaults about image %s: %w", image, err)
 	}
 
-	if cont.Exists("config", "Entrypoint") {
-		for _, v := range cont.S("config", "Entrypoint").Children() {
-			if a, ok := v.Data().(string); ok {
-				ic.Entrypoint = append(ic.Entrypoint, a)
-			}
-		}
+	ic := &ImageConfig{
+		Entrypoint: cf.Config.Entrypoint,
+		Command:    cf.Config.Cmd,
+		Env:        cf.Config.Env,
+		WorkingDir: cf.Config.WorkingDir,
+		User:       cf.Config.User,
+		Labels:     cf.Config.Labels,
+		Digest:     desc.Digest.String(),
+	}
+	for port := range cf.Config.ExposedPorts {
+		ic.ExposedPorts = append(ic.ExposedPorts, port)
 	}
+	sort.Strings(ic.ExposedPorts)
+	// single platform images are returned whatever their platform, the config tells which one it is
+	ic.Platform = (&v1.Platform{OS: cf.OS, Architecture: cf.Architecture, Variant: cf.Variant}).String()
+	return ic, nil
+}
 
-	if cont.Exists("config", "Cmd") {
-		for _, v := range cont.S("config", "Cmd").Children() {
-			if a, ok := v.Data().(string); ok {
-				ic.Command = append(ic.Command, a)
-			}
+// hoconValues is the image config as exposed to kilt definitions in original.image_config. Dots in label keys are
+// replaced with underscores, substitutions could not address them otherwise. When labels end up with the same key,
+// e.g. a.b and a_b, the label spelled with underscores wins, then the first label key in sorted order.
+func (c *ImageConfig) hoconValues() map[string]interface{} {
+	env := make(map[string]interface{})
+	for _, e := range c.Env {
+		name, value, _ := strings.Cut(e, "=")
+		env[name] = value
+	}
+	keys := make([]string, 0, len(c.Labels))
+	for key := range c.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := make(map[string]interface{})
+	for _, key := range keys {
+		replaced := strings.ReplaceAll(key, ".", "_")
+		if _, taken := labels[replaced]; taken && replaced != key {
+			continue
 		}
+		labels[replaced] = c.Labels[key]
 	}
-
-	return ic, nil
-}
\ No newline at end of file
+	values := map[string]interface{}{
+		"env":           env,
+		"labels":        labels,
+		"exposed_ports": append([]string{}, c.ExposedPorts...),
+		"platform":      c.Platform,
+	}
+	if c.Entrypoint != nil {
+		values["entry_point"] = c.Entrypoint
+	}
+	if c.Command != nil {
+		values["command"] = c.Command
+	}
+	if c.WorkingDir != "" {
+		values["working_dir"] = c.WorkingDir
+	}
+	if c.User != "" {
+		values["user"] = c.User
+	}
+	return values
+}
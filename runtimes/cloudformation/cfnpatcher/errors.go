@@ -0,0 +1,68 @@
+package cfnpatcher
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ContainerError is a failure caused by some container definitions of a task definition
+type ContainerError struct {
+	Containers []string
+	Err        error
+}
+
+func (e *ContainerError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ContainerError) Unwrap() error {
+	return e.Err
+}
+
+// ResourceError is a failure to patch a single resource of the template
+type ResourceError struct {
+	Resource   string
+	Containers []string
+	Err        error
+}
+
+func newResourceError(resource string, err error) *ResourceError {
+	e := &ResourceError{
+		Resource: resource,
+		Err:      err,
+	}
+	var containerErr *ContainerError
+	if errors.As(err, &containerErr) {
+		e.Containers = containerErr.Containers
+	}
+	return e
+}
+
+func (e *ResourceError) Error() string {
+	if len(e.Containers) > 0 {
+		return fmt.Sprintf("%s (containers %s): %s", e.Resource, strings.Join(e.Containers, ", "), e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Resource, e.Err)
+}
+
+func (e *ResourceError) Unwrap() error {
+	return e.Err
+}
+
+// PatchError lists every resource that could not be patched when the failure policy is FailurePolicyFail
+type PatchError struct {
+	Failures []*ResourceError
+}
+
+func (e *PatchError) Error() string {
+	failures := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		failures = append(failures, f.Error())
+	}
+	noun := "resource"
+	if len(e.Failures) > 1 {
+		noun = "resources"
+	}
+	return fmt.Sprintf("kilt could not patch %d %s: %s", len(e.Failures), noun, strings.Join(failures, "; "))
+}
@@ -0,0 +1,375 @@
+package cfnpatcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultHintTTL      = 15 * time.Minute
+	DefaultHintErrorTTL = time.Minute
+	DefaultHintWorkers  = 8
+	DefaultHintTimeout  = 10 * time.Second
+)
+
+// DefaultHintCache is shared by every configuration without a HintCache, so that warm functions keep what they
+// learnt about images across invocations
+var DefaultHintCache = &HintCache{}
+
+// ImageLookup identifies the config of an image for a platform, e.g. linux/arm64
+type ImageLookup struct {
+	Image    string
+	Platform string
+}
+
+// HintCache remembers the image configs used as repository hints, by image reference and platform. Concurrent
+// lookups of the same image share a single registry request. Failures are remembered for ErrorTTL so that a
+// template referencing a broken image many times does not wait for the registry every time.
+type HintCache struct {
+	// Lookup retrieves the config of an image, FetchImageConfig with Keychain when nil
+	Lookup func(ctx context.Context, lookup ImageLookup) (*ImageConfig, error)
+	// Keychain authenticates the default lookups against registries, authn.DefaultKeychain when nil
+	Keychain authn.Keychain
+	// TTL is how long a config is kept, DefaultHintTTL when 0. Images pinned by digest never expire.
+	TTL time.Duration
+	// ErrorTTL is how long a failed lookup is kept, DefaultHintErrorTTL when 0
+	ErrorTTL time.Duration
+	// Dir keeps configs on disk as well when set, so that they outlive the process, e.g. for the CLI
+	Dir string
+	// Catalog is consulted before the registry when set
+	Catalog *ImageCatalog
+	// Offline never looks images up, only what is in the Catalog is known
+	Offline bool
+	// ResolveDigest returns the digest an image currently resolves to, a registry request with Keychain when nil
+	ResolveDigest func(ctx context.Context, image string) (string, error)
+
+	now     func() time.Time
+	mu      sync.Mutex
+	entries map[ImageLookup]*hintEntry
+}
+
+// hintEntry is a lookup, done is closed once the other fields are set
+type hintEntry struct {
+	done      chan struct{}
+	config    *ImageConfig
+	err       error
+	fetchedAt time.Time
+}
+
+// diskHint is the content of a file in HintCache.Dir
+type diskHint struct {
+	Image     string       `json:"image"`
+	Platform  string       `json:"platform"`
+	FetchedAt time.Time    `json:"fetchedAt"`
+	Config    *ImageConfig `json:"config"`
+}
+
+func (c *HintCache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// fresh reports whether a completed lookup can still be used
+func (c *HintCache) fresh(image string, config *ImageConfig, err error, fetchedAt time.Time) bool {
+	if err != nil {
+		ttl := c.ErrorTTL
+		if ttl == 0 {
+			ttl = DefaultHintErrorTTL
+		}
+		return c.clock().Sub(fetchedAt) < ttl
+	}
+	if strings.Contains(image, "@sha256:") {
+		return true
+	}
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = DefaultHintTTL
+	}
+	return c.clock().Sub(fetchedAt) < ttl
+}
+
+// Get returns the config of an image, from the cache when possible. It gives up when ctx is done.
+func (c *HintCache) Get(ctx context.Context, lookup ImageLookup) (*ImageConfig, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[lookup]
+	if ok {
+		select {
+		case <-entry.done:
+			ok = c.fresh(lookup.Image, entry.config, entry.err, entry.fetchedAt)
+		default:
+		}
+	}
+	if ok {
+		c.mu.Unlock()
+		select {
+		case <-entry.done:
+			return entry.config, entry.err
+		case <-ctx.Done():
+			return nil, fmt.Errorf("could not get defaults about image %s in time: %w", lookup.Image, ctx.Err())
+		}
+	}
+
+	entry = &hintEntry{done: make(chan struct{})}
+	if c.entries == nil {
+		c.entries = make(map[ImageLookup]*hintEntry)
+	}
+	c.entries[lookup] = entry
+	c.mu.Unlock()
+
+	entry.config, entry.err = c.load(ctx, lookup)
+	entry.fetchedAt = c.clock()
+	if ctx.Err() != nil && entry.err != nil {
+		// running out of time says nothing about the image, the next request tries again
+		c.mu.Lock()
+		if c.entries[lookup] == entry {
+			delete(c.entries, lookup)
+		}
+		c.mu.Unlock()
+	}
+	close(entry.done)
+	return entry.config, entry.err
+}
+
+// Peek returns the outcome of a completed lookup that is still fresh, found is false otherwise
+func (c *HintCache) Peek(lookup ImageLookup) (config *ImageConfig, found bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[lookup]
+	if !ok {
+		return nil, false, nil
+	}
+	select {
+	case <-entry.done:
+	default:
+		return nil, false, nil
+	}
+	if !c.fresh(lookup.Image, entry.config, entry.err, entry.fetchedAt) {
+		return nil, false, nil
+	}
+	return entry.config, true, entry.err
+}
+
+// Digest returns the digest lookup currently resolves to, the one of the index for multi-platform images. Unlike
+// configs, digests are asked to the registry every time, a tag moved since it was cached would pin a stale image.
+// Offline, the digests recorded in the Catalog are used.
+func (c *HintCache) Digest(ctx context.Context, lookup ImageLookup) (string, error) {
+	if c.Offline {
+		config, err := c.Get(ctx, lookup)
+		if err != nil {
+			return "", err
+		}
+		if config.Digest == "" {
+			return "", fmt.Errorf("the catalog records no digest for image %s", lookup.Image)
+		}
+		return config.Digest, nil
+	}
+	if c.ResolveDigest != nil {
+		return c.ResolveDigest(ctx, lookup.Image)
+	}
+	keychain := c.Keychain
+	if keychain == nil {
+		keychain = authn.DefaultKeychain
+	}
+	digest, err := crane.Digest(lookup.Image, crane.WithContext(ctx), crane.WithAuthFromKeychain(keychain))
+	if err != nil {
+		return "", fmt.Errorf("could not resolve image %s: %w", lookup.Image, err)
+	}
+	return digest, nil
+}
+
+// Prefetch looks images up with at most workers concurrent lookups, DefaultHintWorkers when workers is 0. It
+// returns once every image was looked up or ctx is done, whatever is not known by then can be retrieved later.
+func (c *HintCache) Prefetch(ctx context.Context, lookups []ImageLookup, workers int) {
+	if workers <= 0 {
+		workers = DefaultHintWorkers
+	}
+	unique := make([]ImageLookup, 0, len(lookups))
+	seen := make(map[ImageLookup]bool)
+	for _, lookup := range lookups {
+		if !seen[lookup] {
+			seen[lookup] = true
+			unique = append(unique, lookup)
+		}
+	}
+	if workers > len(unique) {
+		workers = len(unique)
+	}
+
+	queue := make(chan ImageLookup)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for lookup := range queue {
+				_, _ = c.Get(ctx, lookup)
+			}
+		}()
+	}
+	for _, lookup := range unique {
+		select {
+		case queue <- lookup:
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+}
+
+func (c *HintCache) load(ctx context.Context, lookup ImageLookup) (*ImageConfig, error) {
+	l := log.Ctx(ctx)
+	if c.Catalog != nil {
+		if config, ok := c.Catalog.Find(lookup); ok {
+			return config, nil
+		}
+	}
+	if c.Offline {
+		return nil, fmt.Errorf("could not get defaults about image %s for %s: %w", lookup.Image, lookup.Platform, ErrNotInCatalog)
+	}
+
+	path := c.path(lookup)
+	if path != "" {
+		config, fetchedAt, err := readDiskHint(path, lookup)
+		if err == nil && c.fresh(lookup.Image, config, nil, fetchedAt) {
+			return config, nil
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			l.Warn().Str("image", lookup.Image).Err(err).Msg("ignoring unreadable cached metadata")
+		}
+	}
+
+	var config *ImageConfig
+	var err error
+	if c.Lookup != nil {
+		config, err = c.Lookup(ctx, lookup)
+	} else {
+		config, err = FetchImageConfig(ctx, lookup.Image, lookup.Platform, c.Keychain)
+	}
+	if err != nil || path == "" {
+		return config, err
+	}
+	err = writeDiskHint(path, diskHint{lookup.Image, lookup.Platform, c.clock(), config})
+	if err != nil {
+		l.Warn().Str("image", lookup.Image).Err(err).Msg("could not cache metadata on disk")
+	}
+	return config, nil
+}
+
+func (c *HintCache) path(lookup ImageLookup) string {
+	if c.Dir == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(lookup.Image + "|" + lookup.Platform))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func readDiskHint(path string, lookup ImageLookup) (*ImageConfig, time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var hint diskHint
+	err = json.Unmarshal(data, &hint)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("could not parse %s: %w", path, err)
+	}
+	if hint.Image != lookup.Image || hint.Platform != lookup.Platform || hint.Config == nil {
+		return nil, time.Time{}, fmt.Errorf("%s does not hold metadata about %s for %s", path, lookup.Image, lookup.Platform)
+	}
+	return hint.Config, hint.FetchedAt, nil
+}
+
+// writeDiskHint replaces path atomically, so that concurrent processes never read a partial file
+func writeDiskHint(path string, hint diskHint) error {
+	data, err := json.Marshal(hint)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".hint-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// containerImage returns the resolved image of container, if it has one
+func containerImage(container *gabs.Container, eval *evaluator) (string, bool, error) {
+	if !container.Exists("Image") {
+		return "", false, nil
+	}
+	image, err := eval.resolveString(container.S("Image"))
+	if err != nil {
+		return "", false, err
+	}
+	return image, true, nil
+}
+
+// repositoryHintLookups lists the images of the containers of resources, for the platform of their task definition.
+// Every image is looked up, the image config is exposed to definitions even when the entrypoint and command are set.
+func repositoryHintLookups(resources []*gabs.Container, eval *evaluator) []ImageLookup {
+	lookups := make([]ImageLookup, 0)
+	for _, resource := range resources {
+		// a platform that cannot be resolved is reported when the resource is patched
+		platform, _ := taskPlatform(resource, eval)
+		for _, c := range flattenContainerDefinitions(resource, eval).containers {
+			image, ok, err := containerImage(gabs.Wrap(c), eval)
+			if ok && err == nil {
+				lookups = append(lookups, ImageLookup{image, platform})
+			}
+		}
+	}
+	return lookups
+}
+
+func (c *Configuration) hintCache() *HintCache {
+	if c.HintCache != nil {
+		return c.HintCache
+	}
+	return DefaultHintCache
+}
+
+// prefetchRepositoryHints looks up the images of resources concurrently, within HintTimeout
+func prefetchRepositoryHints(ctx context.Context, resources []*gabs.Container, eval *evaluator, configuration *Configuration) {
+	lookups := repositoryHintLookups(resources, eval)
+	if len(lookups) == 0 {
+		return
+	}
+	timeout := configuration.HintTimeout
+	if timeout == 0 {
+		timeout = DefaultHintTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	started := time.Now()
+	configuration.hintCache().Prefetch(ctx, lookups, configuration.HintWorkers)
+	log.Ctx(ctx).Info().Int("images", len(lookups)).Dur("duration", time.Since(started)).Msg("retrieved repository hints")
+}
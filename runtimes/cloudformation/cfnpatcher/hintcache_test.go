@@ -0,0 +1,355 @@
+package cfnpatcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingLookup returns the image name as entrypoint and counts lookups per image
+type countingLookup struct {
+	mu    sync.Mutex
+	calls map[string]int
+	fail  bool
+}
+
+func (c *countingLookup) lookup(_ context.Context, lookup ImageLookup) (*ImageConfig, error) {
+	image := lookup.Image
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.calls == nil {
+		c.calls = make(map[string]int)
+	}
+	c.calls[image]++
+	if c.fail {
+		return nil, fmt.Errorf("registry unavailable")
+	}
+	return &ImageConfig{Entrypoint: []string{image}}, nil
+}
+
+func (c *countingLookup) count(image string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[image]
+}
+
+func TestHintCacheDeduplicates(t *testing.T) {
+	release := make(chan struct{})
+	var calls atomic.Int32
+	cache := &HintCache{Lookup: func(ctx context.Context, lookup ImageLookup) (*ImageConfig, error) {
+		calls.Add(1)
+		<-release
+		return &ImageConfig{Entrypoint: []string{lookup.Image}}, nil
+	}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			config, err := cache.Get(context.Background(), ImageLookup{"nginx", DefaultPlatform})
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"nginx"}, config.Entrypoint)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), calls.Load())
+
+	config, found, err := cache.Peek(ImageLookup{"nginx", DefaultPlatform})
+	assert.True(t, found)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"nginx"}, config.Entrypoint)
+	_, found, _ = cache.Peek(ImageLookup{"alpine", DefaultPlatform})
+	assert.False(t, found)
+}
+
+func TestHintCachePrefetchWorkers(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	cache := &HintCache{Lookup: func(ctx context.Context, lookup ImageLookup) (*ImageConfig, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		return &ImageConfig{Entrypoint: []string{lookup.Image}}, nil
+	}}
+
+	lookups := make([]ImageLookup, 0)
+	for i := 0; i < 20; i++ {
+		lookups = append(lookups, ImageLookup{fmt.Sprintf("image-%d", i%10), DefaultPlatform})
+	}
+	cache.Prefetch(context.Background(), lookups, 3)
+	assert.LessOrEqual(t, maxRunning.Load(), int32(3))
+	for i := 0; i < 10; i++ {
+		_, found, err := cache.Peek(ImageLookup{fmt.Sprintf("image-%d", i), DefaultPlatform})
+		assert.True(t, found)
+		assert.NoError(t, err)
+	}
+}
+
+func TestHintCacheDeadline(t *testing.T) {
+	counter := &countingLookup{}
+	cache := &HintCache{Lookup: func(ctx context.Context, lookup ImageLookup) (*ImageConfig, error) {
+		if lookup.Image == "slow" {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return counter.lookup(ctx, lookup)
+	}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	cache.Prefetch(ctx, []ImageLookup{{"slow", DefaultPlatform}, {"fast", DefaultPlatform}}, 2)
+	assert.Less(t, time.Since(started), time.Second)
+
+	_, found, err := cache.Peek(ImageLookup{"fast", DefaultPlatform})
+	assert.True(t, found)
+	assert.NoError(t, err)
+	// running out of time is not remembered as a failure of the image
+	_, found, _ = cache.Peek(ImageLookup{"slow", DefaultPlatform})
+	assert.False(t, found)
+}
+
+func TestHintCacheExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	lookup := &countingLookup{}
+	cache := &HintCache{Lookup: lookup.lookup, TTL: time.Hour, ErrorTTL: time.Minute, now: func() time.Time { return now }}
+	ctx := context.Background()
+	pinned := "nginx@sha256:0000000000000000000000000000000000000000000000000000000000000000"
+
+	for _, image := range []string{"nginx", pinned} {
+		_, err := cache.Get(ctx, ImageLookup{image, DefaultPlatform})
+		require.NoError(t, err)
+		_, err = cache.Get(ctx, ImageLookup{image, DefaultPlatform})
+		require.NoError(t, err)
+		assert.Equal(t, 1, lookup.count(image))
+	}
+
+	now = now.Add(2 * time.Hour)
+	_, err := cache.Get(ctx, ImageLookup{"nginx", DefaultPlatform})
+	require.NoError(t, err)
+	assert.Equal(t, 2, lookup.count("nginx"))
+	_, err = cache.Get(ctx, ImageLookup{pinned, DefaultPlatform})
+	require.NoError(t, err)
+	assert.Equal(t, 1, lookup.count(pinned))
+
+	lookup.fail = true
+	_, err = cache.Get(ctx, ImageLookup{"broken", DefaultPlatform})
+	assert.Error(t, err)
+	_, err = cache.Get(ctx, ImageLookup{"broken", DefaultPlatform})
+	assert.Error(t, err)
+	assert.Equal(t, 1, lookup.count("broken"))
+	now = now.Add(2 * time.Minute)
+	_, err = cache.Get(ctx, ImageLookup{"broken", DefaultPlatform})
+	assert.Error(t, err)
+	assert.Equal(t, 2, lookup.count("broken"))
+}
+
+func TestHintCacheDisk(t *testing.T) {
+	dir := t.TempDir()
+	lookup := &countingLookup{}
+	ctx := context.Background()
+
+	first := &HintCache{Lookup: lookup.lookup, Dir: dir}
+	_, err := first.Get(ctx, ImageLookup{"nginx", DefaultPlatform})
+	require.NoError(t, err)
+
+	// another process finds the config on disk
+	second := &HintCache{Lookup: lookup.lookup, Dir: dir}
+	config, err := second.Get(ctx, ImageLookup{"nginx", DefaultPlatform})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"nginx"}, config.Entrypoint)
+	assert.Equal(t, 1, lookup.count("nginx"))
+
+	// corrupted files are looked up again
+	require.NoError(t, os.WriteFile(second.path(ImageLookup{"nginx", DefaultPlatform}), []byte("{"), 0o600))
+	third := &HintCache{Lookup: lookup.lookup, Dir: dir}
+	_, err = third.Get(ctx, ImageLookup{"nginx", DefaultPlatform})
+	require.NoError(t, err)
+	assert.Equal(t, 2, lookup.count("nginx"))
+
+	// failures are not written to disk
+	lookup.fail = true
+	_, err = third.Get(ctx, ImageLookup{"broken", DefaultPlatform})
+	assert.Error(t, err)
+	_, err = os.Stat(third.path(ImageLookup{"broken", DefaultPlatform}))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+}
+
+func TestFetchImageConfigPlatform(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	ref := strings.TrimPrefix(server.URL, "http://") + "/multiarch:latest"
+
+	index := mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+	for _, platform := range []v1.Platform{{OS: "linux", Architecture: "amd64"}, {OS: "linux", Architecture: "arm64", Variant: "v8"}} {
+		platform := platform
+		img, err := mutate.ConfigFile(empty.Image, &v1.ConfigFile{
+			OS:           platform.OS,
+			Architecture: platform.Architecture,
+			Variant:      platform.Variant,
+			Config: v1.Config{
+				Entrypoint:   []string{"/entrypoint-" + platform.Architecture},
+				Cmd:          []string{"serve"},
+				Env:          []string{"PATH=/usr/bin:/bin", "ARCH=" + platform.Architecture},
+				WorkingDir:   "/srv",
+				User:         "1000:1000",
+				Labels:       map[string]string{"io.kilt.recipe": "java"},
+				ExposedPorts: map[string]struct{}{"8080/tcp": {}, "443/tcp": {}},
+			},
+		})
+		require.NoError(t, err)
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add:        img,
+			Descriptor: v1.Descriptor{Platform: &platform},
+		})
+	}
+	parsed, err := name.ParseReference(ref)
+	require.NoError(t, err)
+	require.NoError(t, remote.WriteIndex(parsed, index))
+	indexDigest, err := index.Digest()
+	require.NoError(t, err)
+
+	keychain := authn.NewMultiKeychain()
+	config, err := FetchImageConfig(context.Background(), ref, "", keychain)
+	require.NoError(t, err)
+	assert.Equal(t, &ImageConfig{
+		Entrypoint:   []string{"/entrypoint-amd64"},
+		Command:      []string{"serve"},
+		Env:          []string{"PATH=/usr/bin:/bin", "ARCH=amd64"},
+		WorkingDir:   "/srv",
+		User:         "1000:1000",
+		Labels:       map[string]string{"io.kilt.recipe": "java"},
+		ExposedPorts: []string{"443/tcp", "8080/tcp"},
+		Platform:     "linux/amd64",
+		Digest:       indexDigest.String(),
+	}, config)
+
+	config, err = FetchImageConfig(context.Background(), ref, "linux/arm64", keychain)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/entrypoint-arm64"}, config.Entrypoint)
+	assert.Equal(t, "linux/arm64/v8", config.Platform)
+	// pinning multi-platform images keeps them multi-platform
+	assert.Equal(t, indexDigest.String(), config.Digest)
+	assert.Equal(t, map[string]interface{}{
+		"entry_point":   []string{"/entrypoint-arm64"},
+		"command":       []string{"serve"},
+		"env":           map[string]interface{}{"PATH": "/usr/bin:/bin", "ARCH": "arm64"},
+		"working_dir":   "/srv",
+		"user":          "1000:1000",
+		"labels":        map[string]interface{}{"io_kilt_recipe": "java"},
+		"exposed_ports": []string{"443/tcp", "8080/tcp"},
+		"platform":      "linux/arm64/v8",
+	}, config.hoconValues())
+
+	_, err = FetchImageConfig(context.Background(), ref, "windows/amd64", keychain)
+	assert.Error(t, err)
+}
+
+func TestImageConfigLabelCollisions(t *testing.T) {
+	config := &ImageConfig{Labels: map[string]string{
+		"a.b":   "dotted",
+		"a_b":   "underscored",
+		"c.d_e": "first",
+		"c_d.e": "second",
+	}}
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, map[string]interface{}{"a_b": "underscored", "c_d_e": "first"}, config.hoconValues()["labels"])
+	}
+}
+
+func TestHintCacheDigestFollowsTags(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	ref := strings.TrimPrefix(server.URL, "http://") + "/app:1.0"
+	parsed, err := name.ParseReference(ref)
+	require.NoError(t, err)
+
+	push := func(entrypoint string) string {
+		img, err := mutate.ConfigFile(empty.Image, &v1.ConfigFile{OS: "linux", Architecture: "amd64", Config: v1.Config{Entrypoint: []string{entrypoint}}})
+		require.NoError(t, err)
+		require.NoError(t, remote.Write(parsed, img))
+		digest, err := img.Digest()
+		require.NoError(t, err)
+		return digest.String()
+	}
+
+	ctx := context.Background()
+	cache := &HintCache{Keychain: authn.NewMultiKeychain()}
+	first := push("/first")
+	config, err := cache.Get(ctx, ImageLookup{ref, DefaultPlatform})
+	require.NoError(t, err)
+	assert.Equal(t, first, config.Digest)
+
+	// the config stays cached, the digest pins what the tag points to now
+	second := push("/second")
+	config, err = cache.Get(ctx, ImageLookup{ref, DefaultPlatform})
+	require.NoError(t, err)
+	assert.Equal(t, first, config.Digest)
+	digest, err := cache.Digest(ctx, ImageLookup{ref, DefaultPlatform})
+	require.NoError(t, err)
+	assert.Equal(t, second, digest)
+
+	// offline, catalogs without digests cannot pin
+	offline := &HintCache{Offline: true, Catalog: &ImageCatalog{}}
+	offline.Catalog.Add(ref, "", &ImageConfig{Entrypoint: []string{"/first"}})
+	_, err = offline.Digest(ctx, ImageLookup{ref, DefaultPlatform})
+	assert.ErrorContains(t, err, "records no digest")
+}
+
+func TestTaskPlatform(t *testing.T) {
+	tests := []struct {
+		runtimePlatform string
+		expected        string
+		err             string
+	}{
+		{``, "linux/amd64", ""},
+		{`{"CpuArchitecture": "ARM64"}`, "linux/arm64", ""},
+		{`{"CpuArchitecture": "X86_64", "OperatingSystemFamily": "WINDOWS_SERVER_2019_FULL"}`, "windows/amd64", ""},
+		{`{"OperatingSystemFamily": "LINUX"}`, "linux/amd64", ""},
+		{`{"CpuArchitecture": "RISCV"}`, "linux/amd64", "unknown CpuArchitecture"},
+		{`{"CpuArchitecture": {"Ref": "Missing"}}`, "linux/amd64", "could not resolve CpuArchitecture"},
+	}
+	for _, test := range tests {
+		resource := gabs.New()
+		if test.runtimePlatform != "" {
+			runtimePlatform, err := gabs.ParseJSON([]byte(test.runtimePlatform))
+			require.NoError(t, err)
+			_, _ = resource.Set(runtimePlatform.Data(), "Properties", "RuntimePlatform")
+		}
+		eval := newEvaluator(gabs.New(), nil, &Configuration{})
+		platform, err := taskPlatform(resource, eval)
+		assert.Equal(t, test.expected, platform, test.runtimePlatform)
+		if test.err == "" {
+			assert.NoError(t, err, test.runtimePlatform)
+		} else {
+			assert.ErrorContains(t, err, test.err, test.runtimePlatform)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package cfnpatcher
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+// maxEvaluationDepth guards against self referencing conditions and absurdly nested intrinsics
+const maxEvaluationDepth = 32
+
+var subVariableRegex = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+// evaluator resolves the subset of CloudFormation intrinsic functions that can be computed at transform time,
+// that is everything that only depends on parameters, pseudo parameters, mappings and conditions
+type evaluator struct {
+	template   *gabs.Container
+	parameters *gabs.Container
+	pseudo     map[string]string
+	conditions map[string]bool
+}
+
+func newEvaluator(template, parameters *gabs.Container, configuration *Configuration) *evaluator {
+	pseudo := map[string]string{
+		"AWS::Partition": "aws",
+		"AWS::URLSuffix": "amazonaws.com",
+	}
+	if configuration.Region != "" {
+		pseudo["AWS::Region"] = configuration.Region
+		if strings.HasPrefix(configuration.Region, "cn-") {
+			pseudo["AWS::Partition"] = "aws-cn"
+			pseudo["AWS::URLSuffix"] = "amazonaws.com.cn"
+		} else if strings.HasPrefix(configuration.Region, "us-gov-") {
+			pseudo["AWS::Partition"] = "aws-us-gov"
+		}
+	}
+	if configuration.AccountID != "" {
+		pseudo["AWS::AccountId"] = configuration.AccountID
+	}
+
+	return &evaluator{
+		template:   template,
+		parameters: parameters,
+		pseudo:     pseudo,
+		conditions: make(map[string]bool),
+	}
+}
+
+// resolveString evaluates value and requires the result to be a string
+func (e *evaluator) resolveString(value *gabs.Container) (string, error) {
+	if value == nil {
+		return "", fmt.Errorf("value is missing")
+	}
+	res, err := e.evaluate(value.Data(), 0)
+	if err != nil {
+		return "", err
+	}
+	s, ok := toString(res)
+	if !ok {
+		return "", fmt.Errorf("value %v does not evaluate to a string", value.String())
+	}
+	return s, nil
+}
+
+func (e *evaluator) evaluate(value interface{}, depth int) (interface{}, error) {
+	if depth > maxEvaluationDepth {
+		return nil, fmt.Errorf("intrinsic function nesting is too deep")
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if len(v) != 1 {
+			return v, nil
+		}
+		for fn, args := range v {
+			switch fn {
+			case "Ref":
+				return e.ref(args)
+			case "Fn::Sub":
+				return e.sub(args, depth)
+			case "Fn::Join":
+				return e.join(args, depth)
+			case "Fn::If":
+				return e.fnIf(args, depth)
+			case "Fn::FindInMap":
+				return e.findInMap(args, depth)
+			case "Fn::Select":
+				return e.selectItem(args, depth)
+			case "Condition":
+				name, ok := args.(string)
+				if !ok {
+					return nil, fmt.Errorf("condition name must be a string")
+				}
+				res, err := e.condition(name, depth+1)
+				return res, err
+			}
+			if strings.HasPrefix(fn, "Fn::") {
+				return nil, fmt.Errorf("%s cannot be evaluated at transform time", fn)
+			}
+		}
+		return v, nil
+	case []interface{}:
+		res := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			r, err := e.evaluate(item, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, r)
+		}
+		return res, nil
+	default:
+		return v, nil
+	}
+}
+
+func (e *evaluator) ref(args interface{}) (interface{}, error) {
+	name, ok := args.(string)
+	if !ok {
+		return nil, fmt.Errorf("Ref target must be a string")
+	}
+	return e.variable(name)
+}
+
+// noValue is what Ref AWS::NoValue evaluates to, callers are expected to drop the property holding it
+type noValue struct{}
+
+func isNoValue(value interface{}) bool {
+	_, ok := value.(noValue)
+	return ok
+}
+
+// variable resolves a parameter or pseudo parameter by name
+func (e *evaluator) variable(name string) (interface{}, error) {
+	if name == "AWS::NoValue" {
+		return noValue{}, nil
+	}
+	if strings.HasPrefix(name, "AWS::") {
+		if value, ok := e.pseudo[name]; ok {
+			return value, nil
+		}
+		return nil, fmt.Errorf("pseudo parameter %s is not known at transform time", name)
+	}
+
+	var value interface{}
+	if e.parameters != nil && e.parameters.Exists(name) {
+		value = e.parameters.S(name).Data()
+	} else if e.template != nil && e.template.Exists("Parameters", name, "Default") {
+		// parameter values are not known outside of a stack operation, e.g. cfn-apply-kilt, fall back to defaults
+		value = e.template.S("Parameters", name, "Default").Data()
+	} else {
+		return nil, fmt.Errorf("could not resolve parameter %s", name)
+	}
+
+	if s, ok := value.(string); ok && e.isListParameter(name) {
+		return toInterfaceSlice(strings.Split(s, ",")), nil
+	}
+	return value, nil
+}
+
+func (e *evaluator) isListParameter(name string) bool {
+	if e.template == nil {
+		return false
+	}
+	parameterType, ok := e.template.S("Parameters", name, "Type").Data().(string)
+	return ok && (parameterType == "CommaDelimitedList" || strings.HasPrefix(parameterType, "List<"))
+}
+
+func (e *evaluator) sub(args interface{}, depth int) (interface{}, error) {
+	var format string
+	variables := make(map[string]interface{})
+	switch a := args.(type) {
+	case string:
+		format = a
+	case []interface{}:
+		if len(a) != 2 {
+			return nil, fmt.Errorf("Fn::Sub expects a string and a variable map")
+		}
+		f, ok := a[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("Fn::Sub format must be a string")
+		}
+		format = f
+		vars, ok := a[1].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Fn::Sub variables must be a map")
+		}
+		variables = vars
+	default:
+		return nil, fmt.Errorf("Fn::Sub expects a string or a list")
+	}
+
+	var subErr error
+	res := subVariableRegex.ReplaceAllStringFunc(format, func(match string) string {
+		name := match[2 : len(match)-1]
+		if strings.HasPrefix(name, "!") {
+			return "${" + name[1:] + "}"
+		}
+
+		var value interface{}
+		var err error
+		if v, ok := variables[name]; ok {
+			value, err = e.evaluate(v, depth+1)
+		} else if strings.Contains(name, ".") && !strings.HasPrefix(name, "AWS::") {
+			err = fmt.Errorf("Fn::Sub attribute reference %s cannot be evaluated at transform time", name)
+		} else {
+			value, err = e.variable(name)
+		}
+		if err == nil {
+			s, ok := toString(value)
+			if ok {
+				return s
+			}
+			err = fmt.Errorf("Fn::Sub variable %s does not evaluate to a string", name)
+		}
+		if subErr == nil {
+			subErr = err
+		}
+		return match
+	})
+	if subErr != nil {
+		return nil, subErr
+	}
+	return res, nil
+}
+
+func (e *evaluator) join(args interface{}, depth int) (interface{}, error) {
+	a, ok := args.([]interface{})
+	if !ok || len(a) != 2 {
+		return nil, fmt.Errorf("Fn::Join expects a delimiter and a list")
+	}
+	delimiter, ok := a[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("Fn::Join delimiter must be a string")
+	}
+	items, err := e.evaluate(a[1], depth+1)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := items.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Fn::Join expects a list of values")
+	}
+
+	parts := make([]string, 0, len(list))
+	for _, item := range list {
+		s, ok := toString(item)
+		if !ok {
+			return nil, fmt.Errorf("Fn::Join item %v is not a string", item)
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, delimiter), nil
+}
+
+func (e *evaluator) fnIf(args interface{}, depth int) (interface{}, error) {
+	a, ok := args.([]interface{})
+	if !ok || len(a) != 3 {
+		return nil, fmt.Errorf("Fn::If expects a condition name and two values")
+	}
+	name, ok := a[0].(string)
+	if !ok {
+		return nil, fmt.Errorf("Fn::If condition name must be a string")
+	}
+	result, err := e.condition(name, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	if result {
+		return e.evaluate(a[1], depth+1)
+	}
+	return e.evaluate(a[2], depth+1)
+}
+
+func (e *evaluator) findInMap(args interface{}, depth int) (interface{}, error) {
+	a, ok := args.([]interface{})
+	if !ok || len(a) != 3 {
+		return nil, fmt.Errorf("Fn::FindInMap expects a map name and two keys")
+	}
+	path := make([]string, 0, 3)
+	for _, item := range a {
+		r, err := e.evaluate(item, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		s, ok := toString(r)
+		if !ok {
+			return nil, fmt.Errorf("Fn::FindInMap keys must evaluate to strings")
+		}
+		path = append(path, s)
+	}
+	if e.template == nil || !e.template.Exists(append([]string{"Mappings"}, path...)...) {
+		return nil, fmt.Errorf("could not find mapping %s", strings.Join(path, "."))
+	}
+	return e.template.S(append([]string{"Mappings"}, path...)...).Data(), nil
+}
+
+func (e *evaluator) selectItem(args interface{}, depth int) (interface{}, error) {
+	a, ok := args.([]interface{})
+	if !ok || len(a) != 2 {
+		return nil, fmt.Errorf("Fn::Select expects an index and a list")
+	}
+	rawIndex, err := e.evaluate(a[0], depth+1)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := toString(rawIndex)
+	if !ok {
+		return nil, fmt.Errorf("Fn::Select index must be a number")
+	}
+	index, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("Fn::Select index must be a number: %w", err)
+	}
+	items, err := e.evaluate(a[1], depth+1)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := items.(string); ok {
+		// CommaDelimitedList parameters may come as a single string
+		items = toInterfaceSlice(strings.Split(s, ","))
+	}
+	list, ok := items.([]interface{})
+	if !ok || index < 0 || index >= len(list) {
+		return nil, fmt.Errorf("Fn::Select index %d is out of range", index)
+	}
+	return list[index], nil
+}
+
+// condition evaluates a named condition from the template Conditions section
+func (e *evaluator) condition(name string, depth int) (bool, error) {
+	if result, ok := e.conditions[name]; ok {
+		return result, nil
+	}
+	if e.template == nil || !e.template.Exists("Conditions", name) {
+		return false, fmt.Errorf("could not find condition %s", name)
+	}
+	result, err := e.conditionExpression(e.template.S("Conditions", name).Data(), depth+1)
+	if err != nil {
+		return false, fmt.Errorf("could not evaluate condition %s: %w", name, err)
+	}
+	e.conditions[name] = result
+	return result, nil
+}
+
+func (e *evaluator) conditionExpression(value interface{}, depth int) (bool, error) {
+	if depth > maxEvaluationDepth {
+		return false, fmt.Errorf("condition nesting is too deep")
+	}
+	expr, ok := value.(map[string]interface{})
+	if !ok || len(expr) != 1 {
+		return false, fmt.Errorf("unsupported condition expression %v", value)
+	}
+	for fn, args := range expr {
+		switch fn {
+		case "Condition":
+			name, ok := args.(string)
+			if !ok {
+				return false, fmt.Errorf("condition name must be a string")
+			}
+			return e.condition(name, depth+1)
+		case "Fn::Equals":
+			a, ok := args.([]interface{})
+			if !ok || len(a) != 2 {
+				return false, fmt.Errorf("Fn::Equals expects two values")
+			}
+			left, err := e.evaluate(a[0], depth+1)
+			if err != nil {
+				return false, err
+			}
+			right, err := e.evaluate(a[1], depth+1)
+			if err != nil {
+				return false, err
+			}
+			return fmt.Sprint(left) == fmt.Sprint(right), nil
+		case "Fn::Not":
+			a, ok := args.([]interface{})
+			if !ok || len(a) != 1 {
+				return false, fmt.Errorf("Fn::Not expects a single condition")
+			}
+			res, err := e.conditionExpression(a[0], depth+1)
+			return !res, err
+		case "Fn::And", "Fn::Or":
+			a, ok := args.([]interface{})
+			if !ok || len(a) == 0 {
+				return false, fmt.Errorf("%s expects a list of conditions", fn)
+			}
+			isAnd := fn == "Fn::And"
+			for _, c := range a {
+				res, err := e.conditionExpression(c, depth+1)
+				if err != nil {
+					return false, err
+				}
+				if isAnd && !res {
+					return false, nil
+				}
+				if !isAnd && res {
+					return true, nil
+				}
+			}
+			return isAnd, nil
+		}
+	}
+	return false, fmt.Errorf("unsupported condition function %v", value)
+}
+
+func toString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	default:
+		return "", false
+	}
+}
+
+func toInterfaceSlice(items []string) []interface{} {
+	res := make([]interface{}, 0, len(items))
+	for _, item := range items {
+		res = append(res, item)
+	}
+	return res
+}
@@ -0,0 +1,135 @@
+package cfnpatcher
+
+import (
+	"testing"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const intrinsicsTemplate = `{
+	"Mappings": {
+		"Images": {
+			"eu-west-1": {"app": "registry.example.com/app:eu"},
+			"us-east-1": {"app": "registry.example.com/app:us"}
+		}
+	},
+	"Conditions": {
+		"IsProd": {"Fn::Equals": [{"Ref": "Env"}, "prod"]},
+		"IsNotProd": {"Fn::Not": [{"Condition": "IsProd"}]},
+		"IsProdInEu": {"Fn::And": [{"Condition": "IsProd"}, {"Fn::Equals": [{"Ref": "AWS::Region"}, "eu-west-1"]}]},
+		"Loop": {"Condition": "Loop"}
+	}
+}`
+
+func TestEvaluator(t *testing.T) {
+	template, _ := gabs.ParseJSON([]byte(intrinsicsTemplate))
+	parameters, _ := gabs.ParseJSON([]byte(`{"Env": "prod", "Tag": "1.2.3", "Repos": ["first", "second"]}`))
+	eval := newEvaluator(template, parameters, &Configuration{Region: "eu-west-1", AccountID: "123456789012"})
+
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{"literal", `"busybox"`, "busybox"},
+		{"ref", `{"Ref": "Tag"}`, "1.2.3"},
+		{"pseudo", `{"Ref": "AWS::Region"}`, "eu-west-1"},
+		{"sub", `{"Fn::Sub": "${AWS::AccountId}.dkr.ecr.${AWS::Region}.${AWS::URLSuffix}/app:${Tag}"}`, "123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:1.2.3"},
+		{"sub-variables", `{"Fn::Sub": ["${Repo}:${Tag}", {"Repo": {"Fn::Select": [1, {"Ref": "Repos"}]}}]}`, "second:1.2.3"},
+		{"sub-escape", `{"Fn::Sub": "${!Literal}"}`, "${Literal}"},
+		{"join", `{"Fn::Join": [":", ["app", {"Ref": "Tag"}]]}`, "app:1.2.3"},
+		{"if", `{"Fn::If": ["IsProd", "prod-image", "dev-image"]}`, "prod-image"},
+		{"if-not", `{"Fn::If": ["IsNotProd", "dev-image", "prod-image"]}`, "prod-image"},
+		{"if-and", `{"Fn::If": ["IsProdInEu", "eu-image", "other-image"]}`, "eu-image"},
+		{"find-in-map", `{"Fn::FindInMap": ["Images", {"Ref": "AWS::Region"}, "app"]}`, "registry.example.com/app:eu"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := gabs.ParseJSON([]byte(tc.value))
+			assert.NoError(t, err)
+			res, err := eval.resolveString(value)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, res)
+		})
+	}
+}
+
+func TestEvaluatorErrors(t *testing.T) {
+	template, _ := gabs.ParseJSON([]byte(intrinsicsTemplate))
+	eval := newEvaluator(template, nil, &Configuration{})
+
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"missing-parameter", `{"Ref": "Tag"}`},
+		{"unknown-pseudo", `{"Fn::Sub": "${AWS::AccountId}.dkr.ecr"}`},
+		{"get-att", `{"Fn::GetAtt": ["Repo", "RepositoryUri"]}`},
+		{"sub-attribute", `{"Fn::Sub": "${Repo.RepositoryUri}:latest"}`},
+		{"missing-mapping", `{"Fn::FindInMap": ["Images", "ap-south-1", "app"]}`},
+		{"condition-loop", `{"Fn::If": ["Loop", "a", "b"]}`},
+		{"not-a-string", `["busybox"]`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := gabs.ParseJSON([]byte(tc.value))
+			assert.NoError(t, err)
+			_, err = eval.resolveString(value)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestEvaluatorParameterDefaults(t *testing.T) {
+	template, _ := gabs.ParseJSON([]byte(`{
+	"Parameters": {
+		"Image": {"Type": "String", "Default": "busybox:default"},
+		"Overridden": {"Type": "String", "Default": "busybox:default"},
+		"Images": {"Type": "CommaDelimitedList", "Default": "first,second"}
+	}
+}`))
+	parameters, _ := gabs.ParseJSON([]byte(`{"Overridden": "busybox:supplied"}`))
+	eval := newEvaluator(template, parameters, &Configuration{})
+
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{`{"Ref": "Image"}`, "busybox:default"},
+		{`{"Ref": "Overridden"}`, "busybox:supplied"},
+		{`{"Fn::Select": [1, {"Ref": "Images"}]}`, "second"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.value, func(t *testing.T) {
+			value, _ := gabs.ParseJSON([]byte(tc.value))
+			res, err := eval.resolveString(value)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, res)
+		})
+	}
+}
+
+func TestParseParametersFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{"object", `{"Image": "busybox"}`, `{"Image":"busybox"}`},
+		{"wrapped", `{"Parameters": {"Image": "busybox"}}`, `{"Image":"busybox"}`},
+		{"aws-cli", `[{"ParameterKey": "Image", "ParameterValue": "busybox"}]`, `{"Image":"busybox"}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := ParseParametersFile([]byte(tc.input))
+			assert.NoError(t, err)
+			assert.JSONEq(t, tc.expected, string(res))
+		})
+	}
+
+	_, err := ParseParametersFile([]byte(`[{"ParameterKey": "Image", "UsePreviousValue": true}]`))
+	assert.Error(t, err)
+	_, err = ParseParametersFile([]byte(`"busybox"`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,49 @@
+package cfnpatcher
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+// ParseParametersFile normalizes a parameters file into the name to value map that Patch expects.
+// Supported formats are a plain {"Name": "Value"} object, the same wrapped in a "Parameters" key
+// (as used by CodePipeline template configurations) and the aws cli
+// [{"ParameterKey": "Name", "ParameterValue": "Value"}] list.
+func ParseParametersFile(data []byte) ([]byte, error) {
+	parsed, err := gabs.ParseJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse parameters file: %w", err)
+	}
+
+	parameters := make(map[string]interface{})
+	switch parsed.Data().(type) {
+	case []interface{}:
+		for i, p := range parsed.Children() {
+			key, ok := p.S("ParameterKey").Data().(string)
+			if !ok {
+				return nil, fmt.Errorf("parameter %d has no ParameterKey", i)
+			}
+			if p.Exists("UsePreviousValue") {
+				return nil, fmt.Errorf("parameter %s uses its previous value, which is not known locally", key)
+			}
+			value, ok := p.S("ParameterValue").Data().(string)
+			if !ok {
+				return nil, fmt.Errorf("parameter %s has no ParameterValue", key)
+			}
+			parameters[key] = value
+		}
+	case map[string]interface{}:
+		if parsed.Exists("Parameters") {
+			parsed = parsed.S("Parameters")
+		}
+		for key, value := range parsed.ChildrenMap() {
+			parameters[key] = value.Data()
+		}
+	default:
+		return nil, fmt.Errorf("parameters file must contain a JSON object or list")
+	}
+
+	return json.Marshal(parameters)
+}
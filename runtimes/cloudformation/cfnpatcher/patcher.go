@@ -2,8 +2,13 @@ package cfnpatcher
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/sysdiglabs/agent-kilt/pkg/kilt"
+	"maps"
+	"sort"
+	"strings"
 
 	"github.com/Jeffail/gabs/v2"
 	"github.com/rs/zerolog/log"
@@ -18,7 +23,29 @@ func containerInConfig(name string, listOfNames []string) bool {
 	return false
 }
 
-func shouldSkip(container *gabs.Container, configuration *Configuration, hints *InstrumentationHints) bool {
+// shouldSkip decides whether a container is left alone and why. Selection rules come first, as they are the policy of
+// whoever operates the macro. After that the most specific setting wins: container DockerLabels first, then the
+// io.kilt.ignore label of the image, as reported by repository hints in imageConfig, then the container lists in
+// kilt-include-containers/kilt-ignore-containers, then the resource wide kilt-include and kilt-ignore tags and
+// finally the global OptIn mode.
+func shouldSkip(container *gabs.Container, imageConfig *ImageConfig, configuration *Configuration, hints *InstrumentationHints, eval *evaluator) (bool, string) {
+	action, matched := selectByRules(configuration.SelectionRules, containerSelectionTarget(container, hints, eval))
+	if matched {
+		return action == RuleExclude, "selection rules"
+	}
+
+	if container.Exists("DockerLabels", KiltIgnoreLabel) {
+		return true, KiltIgnoreLabel + " label"
+	}
+	if container.Exists("DockerLabels", KiltIncludeLabel) {
+		return false, KiltIncludeLabel + " label"
+	}
+	if imageConfig != nil {
+		if value, ok := imageConfig.Labels[KiltIgnoreImageLabel]; ok && !strings.EqualFold(value, "false") {
+			return true, KiltIgnoreImageLabel + " label of the image"
+		}
+	}
+
 	containerNameData := container.S("Name").Data()
 	var containerName string
 	switch containerNameData.(type) {
@@ -31,7 +58,37 @@ func shouldSkip(container *gabs.Container, configuration *Configuration, hints *
 	isForceIncluded := containerInConfig(containerName, hints.IncludeContainersNamed)
 	isExcluded := containerInConfig(containerName, hints.IgnoreContainersNamed)
 
-	return (configuration.OptIn && !isForceIncluded && !hints.HasGlobalInclude) || (!configuration.OptIn && isExcluded)
+	switch {
+	case isExcluded && !configuration.OptIn:
+		return true, KiltIgnoreContainersTag + " tag"
+	case isForceIncluded:
+		return false, KiltIncludeContainersTag + " tag"
+	case hints.HasGlobalIgnore && !configuration.OptIn:
+		return true, KiltIgnoreTag + " tag"
+	case hints.HasGlobalInclude:
+		return false, KiltIncludeTag + " tag"
+	}
+	if configuration.OptIn {
+		return true, "opt-in mode"
+	}
+	return false, "opt-out mode"
+}
+
+// hasLabeledInclude reports whether any container of the task definition opts in through its DockerLabels
+func hasLabeledInclude(resource *gabs.Container) bool {
+	for _, container := range resource.S("Properties", "ContainerDefinitions").Children() {
+		if container.Exists("DockerLabels", KiltIncludeLabel) {
+			return true
+		}
+		if args, ok := fnIfArgs(container.Data()); ok {
+			for _, branch := range args[1:] {
+				if gabs.Wrap(branch).Exists("DockerLabels", KiltIncludeLabel) {
+					return true
+				}
+			}
+		}
+	}
+	return false
 }
 
 func applyParametersPatch(ctx context.Context, template *gabs.Container, configuration *Configuration) (*gabs.Container, error) {
@@ -39,15 +96,43 @@ func applyParametersPatch(ctx context.Context, template *gabs.Container, configu
 		ParametrizeEnvars: configuration.ParameterizeEnvars,
 	}
 
-	k := kilt.NewKiltHoconWithConfig(configuration.Kilt, configuration.RecipeConfig, nil)
-	err := k.PatchCfnTemplate(template, &patchConfig)
+	definition, err := configuration.recipe("")
+	if err != nil {
+		return nil, err
+	}
+	k := kilt.NewKiltHoconWithConfig(definition, configuration.RecipeConfig, nil)
+	err = k.PatchCfnTemplate(template, &patchConfig)
 	if err != nil {
 		return nil, err
 	}
+
+	// recipes of the catalog may need parameters of their own, the ones shared with other recipes are declared once
+	names := make([]string, 0, len(configuration.Recipes))
+	for name := range configuration.Recipes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		recipeParameters := gabs.New()
+		k := kilt.NewKiltHoconWithConfig(configuration.Recipes[name], configuration.RecipeConfig, nil)
+		err = k.PatchCfnTemplate(recipeParameters, &patchConfig)
+		if err != nil {
+			return nil, fmt.Errorf("could not prepare parameters of recipe %s: %w", name, err)
+		}
+		for parameterName, parameter := range recipeParameters.S("Parameters").ChildrenMap() {
+			if !template.Exists("Parameters", parameterName) {
+				_, err = template.Set(parameter.Data(), "Parameters", parameterName)
+				if err != nil {
+					return nil, fmt.Errorf("could not add parameter %s: %w", parameterName, err)
+				}
+			}
+		}
+	}
 	return template, nil
 }
 
-func applyTaskDefinitionPatch(ctx context.Context, name string, resource, parameters *gabs.Container, configuration *Configuration, hints *InstrumentationHints) (*gabs.Container, error) {
+// applyTaskDefinitionPatch patches resource in place and returns the conditions that have to be added to the template
+func applyTaskDefinitionPatch(ctx context.Context, name string, resource *gabs.Container, eval *evaluator, configuration *Configuration, hints *InstrumentationHints) (map[string]interface{}, error) {
 	l := log.Ctx(ctx)
 
 	sidecarConfig := gabs.New()
@@ -67,21 +152,279 @@ func applyTaskDefinitionPatch(ctx context.Context, name string, resource, parame
 		ParametrizeEnvars: configuration.ParameterizeEnvars,
 	}
 
-	k := kilt.NewKiltHoconWithConfig(configuration.Kilt, configuration.RecipeConfig, sidecarConfig)
-	err = k.PatchTaskDefinition(resource, &patchConfig, name, func(container *gabs.Container) bool {
-		if shouldSkip(container, configuration, hints) {
-			l.Info().Msgf("skipping container due to hints in tags")
-			return false
+	containers := flattenContainerDefinitions(resource, eval)
+	conditional := containers.isConditional()
+	if conditional {
+		_, err = resource.Set(containers.containers, "Properties", "ContainerDefinitions")
+		if err != nil {
+			return nil, fmt.Errorf("could not unwrap conditional container definitions: %w", err)
+		}
+	}
+
+	stackOverrides, err := stackConfigOverrides(eval)
+	if err != nil {
+		return nil, err
+	}
+
+	platform, err := taskPlatform(resource, eval)
+	if err != nil && configuration.UseRepositoryHints {
+		l.Warn().Err(err).Str("resource", name).Msgf("using %s for repository hints", platform)
+	}
+	patchConfig.ImageConfig = func(container *gabs.Container) map[string]interface{} {
+		return imageConfigValues(container, platform, eval, configuration)
+	}
+
+	// decide up front which containers are patched, with which recipe and recipe config, every group is then
+	// applied in turn to its own containers
+	type recipeGroup struct {
+		recipe string
+		config string
+	}
+	names := containerNames(containers.containers, eval)
+	selected := make([]bool, len(containers.containers))
+	groups := make([]recipeGroup, len(containers.containers))
+	groupOrder := make([]recipeGroup, 0)
+	for i, c := range containers.containers {
+		container := gabs.Wrap(c)
+		imageConfig := peekImageConfig(container, platform, eval, configuration)
+		if skip, reason := shouldSkip(container, imageConfig, configuration, hints, eval); skip {
+			l.Info().Str("resource", name).Str("container", names[i]).Str("reason", reason).Msgf("skipping container due to %s", reason)
+			continue
+		}
+		recipe, err := recipeName(ctx, container, imageConfig, hints, eval, configuration)
+		if err != nil {
+			return nil, &ContainerError{[]string{names[i]}, err}
+		}
+		if configuration.isFallbackRecipe(recipe) {
+			recipe = ""
+		}
+		labelOverrides, err := labelConfigOverrides(container, eval)
+		if err != nil {
+			return nil, &ContainerError{[]string{names[i]}, err}
+		}
+		recipeConfig, err := mergeRecipeConfig(configuration.RecipeConfig, stackOverrides, hints.ConfigOverrides, labelOverrides)
+		if err != nil {
+			return nil, &ContainerError{[]string{names[i]}, err}
+		}
+
+		group := recipeGroup{recipe, recipeConfig}
+		isNewGroup := true
+		for _, g := range groupOrder {
+			isNewGroup = isNewGroup && g != group
+		}
+		if isNewGroup {
+			groupOrder = append(groupOrder, group)
+		}
+		selected[i] = true
+		groups[i] = group
+	}
+	if len(groupOrder) == 0 {
+		groupOrder = append(groupOrder, recipeGroup{"", configuration.RecipeConfig})
+	}
+
+	// injected lists the variants of every sidecar injected so far, by the name the recipe gives it
+	injected := make(map[string][]sidecarVariant)
+	for _, group := range groupOrder {
+		definition, err := configuration.recipe(group.recipe)
+		if err != nil {
+			groupNames := make([]string, 0)
+			for i := range groups {
+				if selected[i] && groups[i] == group {
+					groupNames = append(groupNames, names[i])
+				}
+			}
+			return nil, &ContainerError{groupNames, err}
 		}
 
-		fillContainerInfo(ctx, container, parameters, configuration)
-		return true
-	})
+		existing, _ := containerDefinitionsData(resource)
+		alreadyPresent := len(existing)
 
+		index := 0
+		k := kilt.NewKiltHoconWithConfig(definition, group.config, sidecarConfig)
+		err = k.PatchTaskDefinition(resource, &patchConfig, name, func(container *gabs.Container) bool {
+			// sidecars injected by a previous group come after the original containers and are never patched
+			i := index
+			index++
+			if i >= len(selected) || !selected[i] || groups[i] != group {
+				return false
+			}
+			fillContainerInfo(ctx, container, platform, eval, configuration)
+			return true
+		})
+		if err != nil {
+			err = fmt.Errorf("could not patch task definition: %w", err)
+			// failures past the containers themselves, e.g. injecting sidecars, concern the whole task definition
+			var containerErr *kilt.ContainerError
+			if errors.As(err, &containerErr) && containerErr.Index < len(names) {
+				return nil, &ContainerError{[]string{names[containerErr.Index]}, err}
+			}
+			return nil, err
+		}
+
+		// kilt stores the container definitions as a gabs container, unwrap them for the next group. Groups may inject
+		// the very same sidecar, e.g. groups sharing a recipe that does not use the recipe config in its sidecars, only
+		// the first copy is kept. A sidecar differing from the ones of the same name, e.g. because its environment
+		// comes from another recipe config, gets a name of its own, which the containers of the group then refer to.
+		if definitions, ok := containerDefinitionsData(resource); ok {
+			kept := make([]interface{}, 0, len(definitions))
+			sidecars := make([]interface{}, 0)
+			for i, definition := range definitions {
+				if c, isContainer := definition.(*gabs.Container); isContainer {
+					definition = c.Data()
+				}
+				if _, isString := gabs.Wrap(definition).S("Name").Data().(string); i < alreadyPresent || !isString {
+					kept = append(kept, definition)
+				} else {
+					sidecars = append(sidecars, definition)
+				}
+			}
+			renamed, err := sidecarNames(sidecars, injected)
+			if err != nil {
+				return nil, err
+			}
+			for i := range selected {
+				if selected[i] && groups[i] == group && i < len(kept) {
+					renameReferences(gabs.Wrap(kept[i]), renamed)
+				}
+			}
+			for _, definition := range sidecars {
+				sidecar := gabs.Wrap(definition)
+				sidecarName := sidecar.S("Name").Data().(string)
+				renameReferences(sidecar, renamed)
+				encoded, err := json.Marshal(definition)
+				if err != nil {
+					return nil, fmt.Errorf("could not compare sidecar %s: %w", sidecarName, err)
+				}
+				if findVariant(injected[sidecarName], string(encoded)) != "" {
+					continue
+				}
+				name := variantName(sidecarName, len(injected[sidecarName]))
+				injected[sidecarName] = append(injected[sidecarName], sidecarVariant{name, string(encoded)})
+				if name != sidecarName {
+					_, err = sidecar.Set(name, "Name")
+					if err != nil {
+						return nil, fmt.Errorf("could not rename sidecar %s: %w", sidecarName, err)
+					}
+				}
+				kept = append(kept, definition)
+			}
+			_, err = resource.Set(kept, "Properties", "ContainerDefinitions")
+			if err != nil {
+				return nil, fmt.Errorf("could not update container definitions: %w", err)
+			}
+		}
+	}
+
+	if err := checkDuplicateContainerNames(resource); err != nil {
+		return nil, err
+	}
+
+	err = pinImages(ctx, resource, len(containers.containers), selected, platform, eval, configuration)
 	if err != nil {
-		return nil, fmt.Errorf("could not patch task definition: %w", err)
+		return nil, err
+	}
+
+	if conditional {
+		conditions, err := containers.restore(resource, name, selected)
+		if err != nil {
+			return nil, fmt.Errorf("could not restore conditional container definitions: %w", err)
+		}
+		return conditions, nil
+	}
+	return nil, nil
+}
+
+// sidecarVariant is a sidecar as injected under name, definition is its JSON encoding before it was renamed
+type sidecarVariant struct {
+	name       string
+	definition string
+}
+
+// sidecarNames returns the names sidecars are injected under when they differ from their injected variants. Sidecars
+// are compared once their references to renamed sidecars are rewritten, which may rename further sidecars, so this is
+// repeated until the names settle.
+func sidecarNames(sidecars []interface{}, injected map[string][]sidecarVariant) (map[string]string, error) {
+	renamed := make(map[string]string)
+	for range sidecars {
+		next := make(map[string]string)
+		for _, definition := range sidecars {
+			sidecarName := gabs.Wrap(definition).S("Name").Data().(string)
+			encoded, err := json.Marshal(definition)
+			if err != nil {
+				return nil, fmt.Errorf("could not compare sidecar %s: %w", sidecarName, err)
+			}
+			var sidecar interface{}
+			err = json.Unmarshal(encoded, &sidecar)
+			if err != nil {
+				return nil, fmt.Errorf("could not compare sidecar %s: %w", sidecarName, err)
+			}
+			renameReferences(gabs.Wrap(sidecar), renamed)
+			encoded, err = json.Marshal(sidecar)
+			if err != nil {
+				return nil, fmt.Errorf("could not compare sidecar %s: %w", sidecarName, err)
+			}
+			name := findVariant(injected[sidecarName], string(encoded))
+			if name == "" {
+				name = variantName(sidecarName, len(injected[sidecarName]))
+			}
+			if name != sidecarName {
+				next[sidecarName] = name
+			}
+		}
+		if maps.Equal(next, renamed) {
+			break
+		}
+		renamed = next
+	}
+	return renamed, nil
+}
+
+// findVariant returns the name of the variant encoded as definition, empty when there is none
+func findVariant(variants []sidecarVariant, definition string) string {
+	for _, variant := range variants {
+		if variant.definition == definition {
+			return variant.name
+		}
+	}
+	return ""
+}
+
+// variantName is the name of a sidecar injected after count variants of it
+func variantName(sidecarName string, count int) string {
+	if count == 0 {
+		return sidecarName
+	}
+	return fmt.Sprintf("%s-%d", sidecarName, count+1)
+}
+
+// renameReferences points the VolumesFrom, DependsOn and Links of container at the renamed sidecars
+func renameReferences(container *gabs.Container, renamed map[string]string) {
+	if len(renamed) == 0 {
+		return
+	}
+	for _, volume := range container.S("VolumesFrom").Children() {
+		source, ok := volume.S("SourceContainer").Data().(string)
+		if name, isRenamed := renamed[source]; ok && isRenamed {
+			_, _ = volume.Set(name, "SourceContainer")
+		}
+	}
+	for _, dependency := range container.S("DependsOn").Children() {
+		dependsOn, ok := dependency.S("ContainerName").Data().(string)
+		if name, isRenamed := renamed[dependsOn]; ok && isRenamed {
+			_, _ = dependency.Set(name, "ContainerName")
+		}
+	}
+	for i, link := range container.S("Links").Children() {
+		// links are either a container name or name:alias
+		target, ok := link.Data().(string)
+		linked, alias, hasAlias := strings.Cut(target, ":")
+		if name, isRenamed := renamed[linked]; ok && isRenamed {
+			if hasAlias {
+				name += ":" + alias
+			}
+			_, _ = container.S("Links").SetIndex(name, i)
+		}
 	}
-	return resource, nil
 }
 
 func applyConfiguration(container *gabs.Container, configuration *Configuration, taskName string) error {
@@ -109,3 +452,34 @@ func prepareLogConfiguration(taskName string, logGroup string) map[string]interf
 
 	return config
 }
+
+// containerNames names container definitions for error messages, falling back to their position when the name
+// cannot be evaluated
+func containerNames(containers []interface{}, eval *evaluator) []string {
+	names := make([]string, len(containers))
+	for i, c := range containers {
+		name, err := eval.resolveString(gabs.Wrap(c).S("Name"))
+		if err != nil || name == "" {
+			name = fmt.Sprintf("#%d", i)
+		}
+		names[i] = name
+	}
+	return names
+}
+
+// checkDuplicateContainerNames catches recipes injecting sidecars with the same name into a task definition
+func checkDuplicateContainerNames(resource *gabs.Container) error {
+	definitions, _ := containerDefinitionsData(resource)
+	names := make(map[string]bool)
+	for _, definition := range definitions {
+		name, ok := gabs.Wrap(definition).S("Name").Data().(string)
+		if !ok {
+			continue
+		}
+		if names[name] {
+			return fmt.Errorf("container name %s is used more than once, check the sidecars of the chosen recipes", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
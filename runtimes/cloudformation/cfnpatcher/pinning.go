@@ -0,0 +1,135 @@
+package cfnpatcher
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/rs/zerolog/log"
+)
+
+// ImagePinning selects the images that are replaced by their digest at transform time, so that every deployment of
+// a template runs the images that were current when it was transformed
+type ImagePinning string
+
+const (
+	// ImagePinningNone leaves images as they are written
+	ImagePinningNone ImagePinning = "none"
+	// ImagePinningSidecars pins the images of injected sidecars
+	ImagePinningSidecars ImagePinning = "sidecars"
+	// ImagePinningAll pins the images of injected sidecars and of the patched containers
+	ImagePinningAll ImagePinning = "all"
+)
+
+var ImagePinnings = []ImagePinning{ImagePinningNone, ImagePinningSidecars, ImagePinningAll}
+
+func ParseImagePinning(pinning string) (ImagePinning, error) {
+	if pinning == "" {
+		return ImagePinningNone, nil
+	}
+	for _, v := range ImagePinnings {
+		if ImagePinning(pinning) == v {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("unknown image pinning %q, expected one of %v", pinning, ImagePinnings)
+}
+
+// PinFailurePolicy decides what happens to an image whose digest could not be resolved
+type PinFailurePolicy string
+
+const (
+	// PinFailureKeepTag leaves the image as it is written and logs a warning
+	PinFailureKeepTag PinFailurePolicy = "keep-tag"
+	// PinFailureFail fails the task definition, which is then handled by the FailurePolicy
+	PinFailureFail PinFailurePolicy = "fail"
+)
+
+var PinFailurePolicies = []PinFailurePolicy{PinFailureKeepTag, PinFailureFail}
+
+func ParsePinFailurePolicy(policy string) (PinFailurePolicy, error) {
+	if policy == "" {
+		return PinFailureKeepTag, nil
+	}
+	for _, v := range PinFailurePolicies {
+		if PinFailurePolicy(policy) == v {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("unknown pin failure policy %q, expected one of %v", policy, PinFailurePolicies)
+}
+
+// KiltOriginalImageLabel is the DockerLabel recording the image of a container before it was pinned
+const KiltOriginalImageLabel = "kilt.original-image"
+
+// pinImages replaces the images of the container definitions of resource by their digest for platform. The first
+// originals definitions are the containers of the task definition, pinned with ImagePinningAll when they were
+// patched, the others are injected sidecars.
+func pinImages(ctx context.Context, resource *gabs.Container, originals int, patched []bool, platform string, eval *evaluator, configuration *Configuration) error {
+	if configuration.ImagePinning == "" || configuration.ImagePinning == ImagePinningNone {
+		return nil
+	}
+	l := log.Ctx(ctx)
+	definitions, _ := containerDefinitionsData(resource)
+	names := containerNames(definitions, eval)
+	for i, definition := range definitions {
+		if i < originals && (configuration.ImagePinning != ImagePinningAll || i >= len(patched) || !patched[i]) {
+			continue
+		}
+		container := gabs.Wrap(definition)
+		image, hasImage, err := containerImage(container, eval)
+		if !hasImage && err == nil {
+			continue
+		}
+		if err == nil {
+			if strings.Contains(image, "@") {
+				continue
+			}
+			var pinned string
+			pinned, err = pinImage(ctx, image, platform, configuration)
+			if err == nil {
+				_, err = container.Set(pinned, "Image")
+			}
+			if err == nil {
+				_, err = container.Set(image, "DockerLabels", KiltOriginalImageLabel)
+			}
+			if err == nil {
+				l.Info().Str("image", image).Msgf("pinned image to %s", pinned)
+				continue
+			}
+		}
+		if configuration.PinFailurePolicy == PinFailureFail {
+			return &ContainerError{[]string{names[i]}, fmt.Errorf("could not pin image: %w", err)}
+		}
+		l.Warn().Str("image", container.S("Image").String()).Err(err).Msg("could not pin image, keeping its tag")
+	}
+	return nil
+}
+
+// pinImage returns image with its tag replaced by the digest it currently resolves to, as reported by
+// HintCache.Digest. The digest of multi-platform images is the one of their index, platform only matters offline.
+func pinImage(ctx context.Context, image string, platform string, configuration *Configuration) (string, error) {
+	ref, err := name.ParseReference(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image %s: %w", image, err)
+	}
+
+	timeout := configuration.HintTimeout
+	if timeout == 0 {
+		timeout = DefaultHintTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	digest, err := configuration.hintCache().Digest(ctx, ImageLookup{image, platform})
+	if err != nil {
+		return "", err
+	}
+
+	repository := image
+	if tag, ok := ref.(name.Tag); ok {
+		repository = strings.TrimSuffix(image, ":"+tag.TagStr())
+	}
+	return repository + "@" + digest, nil
+}
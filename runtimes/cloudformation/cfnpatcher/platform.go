@@ -0,0 +1,48 @@
+package cfnpatcher
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+// DefaultPlatform is the platform of task definitions without a RuntimePlatform, the default of Fargate
+const DefaultPlatform = "linux/amd64"
+
+var cpuArchitectures = map[string]string{
+	"X86_64": "amd64",
+	"ARM64":  "arm64",
+}
+
+// taskPlatform returns the os/architecture of the images run by a task definition, from its RuntimePlatform
+func taskPlatform(resource *gabs.Container, eval *evaluator) (string, error) {
+	os, architecture := "linux", "amd64"
+
+	if resource.Exists("Properties", "RuntimePlatform", "OperatingSystemFamily") {
+		value, err := eval.resolveString(resource.S("Properties", "RuntimePlatform", "OperatingSystemFamily"))
+		if err != nil {
+			return DefaultPlatform, fmt.Errorf("could not resolve OperatingSystemFamily: %w", err)
+		}
+		switch {
+		case value == "LINUX":
+		case strings.HasPrefix(value, "WINDOWS_SERVER_"):
+			os = "windows"
+		default:
+			return DefaultPlatform, fmt.Errorf("unknown OperatingSystemFamily %s", value)
+		}
+	}
+
+	if resource.Exists("Properties", "RuntimePlatform", "CpuArchitecture") {
+		value, err := eval.resolveString(resource.S("Properties", "RuntimePlatform", "CpuArchitecture"))
+		if err != nil {
+			return DefaultPlatform, fmt.Errorf("could not resolve CpuArchitecture: %w", err)
+		}
+		var ok bool
+		architecture, ok = cpuArchitectures[value]
+		if !ok {
+			return DefaultPlatform, fmt.Errorf("unknown CpuArchitecture %s", value)
+		}
+	}
+	return os + "/" + architecture, nil
+}
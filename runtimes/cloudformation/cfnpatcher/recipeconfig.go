@@ -0,0 +1,126 @@
+package cfnpatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+// KiltConfigTagPrefix and KiltConfigLabelPrefix mark tags and DockerLabels overriding a key of the recipe config,
+// dots in the rest of the key address nested objects, e.g. kilt.config.collector.port
+const KiltConfigTagPrefix = "kilt-config-"
+const KiltConfigLabelPrefix = "kilt.config."
+
+// KiltMetadataKey is the template Metadata section holding stack wide settings, recipe config overrides go in Config
+const KiltMetadataKey = "Kilt"
+
+// stackConfigOverrides reads the recipe config overrides declared in the template Metadata
+func stackConfigOverrides(eval *evaluator) (map[string]interface{}, error) {
+	if eval.template == nil || !eval.template.Exists("Metadata", KiltMetadataKey, "Config") {
+		return nil, nil
+	}
+	value, err := eval.evaluate(eval.template.S("Metadata", KiltMetadataKey, "Config").Data(), 0)
+	if err != nil {
+		return nil, fmt.Errorf("could not evaluate Metadata.%s.Config: %w", KiltMetadataKey, err)
+	}
+	overrides, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Metadata.%s.Config must be an object", KiltMetadataKey)
+	}
+	return overrides, nil
+}
+
+// tagConfigOverrides collects the kilt-config-<key> tags of a task definition
+func tagConfigOverrides(tags map[string]string) map[string]interface{} {
+	overrides := make(map[string]interface{})
+	for k, v := range tags {
+		if strings.HasPrefix(k, KiltConfigTagPrefix) {
+			setConfigPath(overrides, strings.TrimPrefix(k, KiltConfigTagPrefix), v)
+		}
+	}
+	return overrides
+}
+
+// labelConfigOverrides collects the kilt.config.<key> DockerLabels of a container
+func labelConfigOverrides(container *gabs.Container, eval *evaluator) (map[string]interface{}, error) {
+	overrides := make(map[string]interface{})
+	for k, v := range container.S("DockerLabels").ChildrenMap() {
+		if !strings.HasPrefix(k, KiltConfigLabelPrefix) {
+			continue
+		}
+		value, err := eval.resolveString(v)
+		if err != nil {
+			return nil, fmt.Errorf("could not evaluate label %s: %w", k, err)
+		}
+		setConfigPath(overrides, strings.TrimPrefix(k, KiltConfigLabelPrefix), value)
+	}
+	return overrides, nil
+}
+
+func setConfigPath(config map[string]interface{}, key string, value interface{}) {
+	path := strings.Split(key, ".")
+	current := config
+	for _, segment := range path[:len(path)-1] {
+		next, ok := current[segment].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			current[segment] = next
+		}
+		current = next
+	}
+	current[path[len(path)-1]] = value
+}
+
+// mergeRecipeConfig deep merges overrides, in order, over the global recipe config. Objects are merged key by key,
+// any other value is replaced. The global recipe config is returned untouched when there is nothing to merge.
+func mergeRecipeConfig(global string, overrides ...map[string]interface{}) (string, error) {
+	hasOverrides := false
+	for _, o := range overrides {
+		hasOverrides = hasOverrides || len(o) > 0
+	}
+	if !hasOverrides {
+		return global, nil
+	}
+
+	merged := make(map[string]interface{})
+	if strings.TrimSpace(global) != "" {
+		parsed, err := gabs.ParseJSON([]byte(global))
+		if err != nil {
+			return "", fmt.Errorf("recipe config must be a JSON object to apply overrides: %w", err)
+		}
+		m, ok := parsed.Data().(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("recipe config must be a JSON object to apply overrides")
+		}
+		merged = m
+	}
+	for _, o := range overrides {
+		deepMerge(merged, o)
+	}
+
+	res, err := json.Marshal(merged)
+	if err != nil {
+		return "", fmt.Errorf("could not serialize recipe config: %w", err)
+	}
+	return string(res), nil
+}
+
+func deepMerge(dst, src map[string]interface{}) {
+	for k := range src {
+		srcMap, srcIsMap := src[k].(map[string]interface{})
+		dstMap, dstIsMap := dst[k].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			deepMerge(dstMap, srcMap)
+			continue
+		}
+		if srcIsMap {
+			copied := make(map[string]interface{})
+			deepMerge(copied, srcMap)
+			dst[k] = copied
+			continue
+		}
+		dst[k] = src[k]
+	}
+}
@@ -0,0 +1,64 @@
+package cfnpatcher
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/rs/zerolog/log"
+)
+
+const KiltRecipeTag = "kilt-recipe"
+const KiltRecipeLabel = "kilt.recipe"
+
+// recipeName returns the name of the recipe chosen for a container, the DockerLabel takes precedence over the
+// io.kilt.recipe label of the image, from imageConfig when known, and then over the tag of the task definition. An
+// empty name stands for the default recipe. Images are not under the control of the stack author, their label is
+// ignored with a warning when it names a recipe missing from the catalog.
+func recipeName(ctx context.Context, container *gabs.Container, imageConfig *ImageConfig, hints *InstrumentationHints, eval *evaluator, configuration *Configuration) (string, error) {
+	if container.Exists("DockerLabels", KiltRecipeLabel) {
+		name, err := eval.resolveString(container.S("DockerLabels", KiltRecipeLabel))
+		if err != nil {
+			return "", fmt.Errorf("could not evaluate %s label: %w", KiltRecipeLabel, err)
+		}
+		return name, nil
+	}
+	if imageConfig != nil && imageConfig.Labels[KiltRecipeImageLabel] != "" {
+		name := imageConfig.Labels[KiltRecipeImageLabel]
+		if _, ok := configuration.Recipes[name]; ok {
+			return name, nil
+		}
+		log.Ctx(ctx).Warn().Str("recipe", name).Msgf("ignoring unknown recipe of the %s image label", KiltRecipeImageLabel)
+	}
+	return hints.Recipe, nil
+}
+
+// recipe returns the kilt definition of the named recipe. The empty name stands for containers without a recipe,
+// which get Kilt, or the DefaultRecipe from the catalog when Kilt is empty. Any other name comes from the catalog.
+func (c *Configuration) recipe(name string) (string, error) {
+	if name == "" {
+		if c.Kilt == "" && c.DefaultRecipe != "" {
+			return c.recipeFromCatalog(c.DefaultRecipe)
+		}
+		return c.Kilt, nil
+	}
+	return c.recipeFromCatalog(name)
+}
+
+// isFallbackRecipe reports whether the named recipe is the very definition containers without a recipe get, so that
+// both are patched together
+func (c *Configuration) isFallbackRecipe(name string) bool {
+	if name == "" || name != c.DefaultRecipe {
+		return false
+	}
+	definition, ok := c.Recipes[name]
+	return ok && (c.Kilt == "" || c.Kilt == definition)
+}
+
+func (c *Configuration) recipeFromCatalog(name string) (string, error) {
+	definition, ok := c.Recipes[name]
+	if !ok {
+		return "", fmt.Errorf("unknown recipe %s", name)
+	}
+	return definition, nil
+}
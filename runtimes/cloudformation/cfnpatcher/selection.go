@@ -0,0 +1,177 @@
+package cfnpatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+type RuleAction string
+
+const (
+	RuleInclude RuleAction = "include"
+	RuleExclude RuleAction = "exclude"
+)
+
+// SelectionRule includes or excludes containers matching all of its patterns. Patterns are globs where `*` matches
+// any sequence of characters and `?` a single one, unless they are enclosed in slashes, e.g. `/^app-[0-9]+$/`,
+// in which case they are regular expressions. Empty patterns match anything.
+type SelectionRule struct {
+	Action        RuleAction `json:"action"`
+	Image         string     `json:"image,omitempty"`
+	LogicalID     string     `json:"logicalId,omitempty"`
+	Family        string     `json:"family,omitempty"`
+	ContainerName string     `json:"containerName,omitempty"`
+
+	// patterns are the compiled Image, LogicalID, Family and ContainerName, nil for empty ones
+	patterns []*regexp.Regexp
+}
+
+// selectionTarget is what selection rules are matched against
+type selectionTarget struct {
+	LogicalID     string
+	Family        string
+	Image         string
+	ContainerName string
+}
+
+// ParseSelectionRules parses and validates a JSON list of selection rules, their patterns are compiled once here
+func ParseSelectionRules(data string) ([]SelectionRule, error) {
+	rules := make([]SelectionRule, 0)
+	if strings.TrimSpace(data) == "" {
+		return rules, nil
+	}
+	err := json.Unmarshal([]byte(data), &rules)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse selection rules: %w", err)
+	}
+	return compileSelectionRules(rules)
+}
+
+// compileSelectionRules validates rules and compiles their patterns, rules already compiled are kept as they are
+func compileSelectionRules(rules []SelectionRule) ([]SelectionRule, error) {
+	for i := range rules {
+		err := rules[i].compile()
+		if err != nil {
+			return nil, fmt.Errorf("selection rule %d: %w", i, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *SelectionRule) compile() error {
+	if r.patterns != nil {
+		return nil
+	}
+	if r.Action != RuleInclude && r.Action != RuleExclude {
+		return fmt.Errorf("unknown action %q, expected %q or %q", r.Action, RuleInclude, RuleExclude)
+	}
+	patterns := make([]*regexp.Regexp, 0, 4)
+	for _, pattern := range []string{r.Image, r.LogicalID, r.Family, r.ContainerName} {
+		var re *regexp.Regexp
+		if pattern != "" {
+			var err error
+			re, err = compilePattern(pattern)
+			if err != nil {
+				return err
+			}
+		}
+		patterns = append(patterns, re)
+	}
+	r.patterns = patterns
+	return nil
+}
+
+// withCompiledSelectionRules returns configuration with every selection rule compiled. Rules built in code rather
+// than by ParseSelectionRules are compiled on a copy, configurations may be shared by concurrent patches.
+func withCompiledSelectionRules(configuration *Configuration) (*Configuration, error) {
+	for _, rule := range configuration.SelectionRules {
+		if rule.patterns == nil {
+			rules, err := compileSelectionRules(append([]SelectionRule(nil), configuration.SelectionRules...))
+			if err != nil {
+				return nil, err
+			}
+			compiled := *configuration
+			compiled.SelectionRules = rules
+			return &compiled, nil
+		}
+	}
+	return configuration, nil
+}
+
+// matches tells whether target matches every pattern of a compiled rule
+func (r *SelectionRule) matches(target selectionTarget) bool {
+	for i, value := range []string{target.Image, target.LogicalID, target.Family, target.ContainerName} {
+		if re := r.patterns[i]; re != nil && !re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectByRules returns the action of the first rule matching target
+func selectByRules(rules []SelectionRule, target selectionTarget) (RuleAction, bool) {
+	for _, rule := range rules {
+		if rule.matches(target) {
+			return rule.Action, true
+		}
+	}
+	return "", false
+}
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %s: %w", pattern, err)
+		}
+		return re, nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("^")
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+// containerSelectionTarget describes a container for selection rules, values that cannot be evaluated are left empty
+func containerSelectionTarget(container *gabs.Container, hints *InstrumentationHints, eval *evaluator) selectionTarget {
+	target := selectionTarget{
+		LogicalID: hints.LogicalID,
+		Family:    hints.Family,
+	}
+	if eval != nil {
+		target.Image, _ = eval.resolveString(container.S("Image"))
+		target.ContainerName, _ = eval.resolveString(container.S("Name"))
+	}
+	return target
+}
+
+// resourceSelection applies selection rules to every container of a task definition. It reports whether any
+// container is explicitly included and whether all of them are explicitly excluded.
+func resourceSelection(resource *gabs.Container, hints *InstrumentationHints, eval *evaluator, rules []SelectionRule) (anyIncluded bool, allExcluded bool) {
+	if len(rules) == 0 {
+		return false, false
+	}
+	containers := flattenContainerDefinitions(resource, eval).containers
+	allExcluded = len(containers) > 0
+	for _, c := range containers {
+		action, matched := selectByRules(rules, containerSelectionTarget(gabs.Wrap(c), hints, eval))
+		anyIncluded = anyIncluded || (matched && action == RuleInclude)
+		allExcluded = allExcluded && matched && action == RuleExclude
+	}
+	return anyIncluded, allExcluded
+}
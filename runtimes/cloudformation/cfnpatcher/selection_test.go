@@ -0,0 +1,90 @@
+package cfnpatcher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompilePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		value   string
+		out     bool
+	}{
+		{"busybox", "busybox", true},
+		{"busybox", "busybox:latest", false},
+		{"*.dkr.ecr.*.amazonaws.com/*", "123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:1.0", true},
+		{"app-?", "app-1", true},
+		{"app-?", "app-10", false},
+		{"app.1", "appx1", false},
+		{"/^app-[0-9]+$/", "app-10", true},
+		{"/^app-[0-9]+$/", "app-x", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.pattern+"="+tc.value, func(t *testing.T) {
+			re, err := compilePattern(tc.pattern)
+			require.NoError(t, err)
+			assert.Equal(t, tc.out, re.MatchString(tc.value))
+		})
+	}
+}
+
+func TestSelectByRulesFirstMatch(t *testing.T) {
+	rules, err := compileSelectionRules([]SelectionRule{
+		{Action: RuleExclude, Image: "*/legacy/*"},
+		{Action: RuleInclude, Image: "registry.example.com/*"},
+		{Action: RuleExclude, ContainerName: "*"},
+	})
+	require.NoError(t, err)
+
+	action, matched := selectByRules(rules, selectionTarget{Image: "registry.example.com/legacy/app", ContainerName: "app"})
+	assert.True(t, matched)
+	assert.Equal(t, RuleExclude, action)
+
+	action, matched = selectByRules(rules, selectionTarget{Image: "registry.example.com/app", ContainerName: "app"})
+	assert.True(t, matched)
+	assert.Equal(t, RuleInclude, action)
+
+	action, matched = selectByRules(rules, selectionTarget{Image: "busybox", ContainerName: "app"})
+	assert.True(t, matched)
+	assert.Equal(t, RuleExclude, action)
+
+	_, matched = selectByRules(rules[:2], selectionTarget{Image: "busybox"})
+	assert.False(t, matched)
+}
+
+func TestParseSelectionRules(t *testing.T) {
+	rules, err := ParseSelectionRules(`[{"action": "include", "image": "*"}]`)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 1)
+
+	rules, err = ParseSelectionRules("")
+	assert.NoError(t, err)
+	assert.Len(t, rules, 0)
+
+	_, err = ParseSelectionRules(`[{"action": "maybe"}]`)
+	assert.Error(t, err)
+	_, err = ParseSelectionRules(`[{"action": "include", "image": "/[/"}]`)
+	assert.Error(t, err)
+}
+
+func TestSelectionRulesBuiltInCode(t *testing.T) {
+	rules := []SelectionRule{{Action: RuleExclude, ContainerName: "app"}}
+	configuration := &Configuration{SelectionRules: rules}
+	compiled, err := withCompiledSelectionRules(configuration)
+	require.NoError(t, err)
+	assert.Nil(t, configuration.SelectionRules[0].patterns, "shared configurations are left alone")
+	action, matched := selectByRules(compiled.SelectionRules, selectionTarget{ContainerName: "app"})
+	assert.True(t, matched)
+	assert.Equal(t, RuleExclude, action)
+	again, err := withCompiledSelectionRules(compiled)
+	require.NoError(t, err)
+	assert.Same(t, compiled, again)
+
+	// invalid patterns fail instead of never matching
+	configuration.SelectionRules = []SelectionRule{{Action: RuleExclude, Image: "/[/"}}
+	_, err = withCompiledSelectionRules(configuration)
+	assert.ErrorContains(t, err, "invalid regular expression")
+}
@@ -0,0 +1,177 @@
+package cfnpatcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Jeffail/gabs/v2"
+)
+
+// snippetKind tells what a fragment handed over by a snippet level Fn::Transform holds
+type snippetKind int
+
+const (
+	// snippetNone is a whole template
+	snippetNone snippetKind = iota
+	// snippetResource is a single task definition resource, Fn::Transform was placed next to its Type
+	snippetResource
+	// snippetProperties is the Properties of a task definition, Fn::Transform was placed inside them
+	snippetProperties
+)
+
+// defaultSnippetLogicalID names the task definition of a snippet when the transform does not provide a LogicalId
+const defaultSnippetLogicalID = "TaskDefinition"
+
+func detectSnippet(fragment *gabs.Container) snippetKind {
+	switch {
+	case fragment.Exists("Resources"):
+		return snippetNone
+	case isTaskDefinition(fragment):
+		return snippetResource
+	case fragment.Exists("ContainerDefinitions"):
+		return snippetProperties
+	default:
+		return snippetNone
+	}
+}
+
+// wrapSnippet builds a template holding the snippet as its only resource, so that it goes through the same code
+// path as a whole template
+func wrapSnippet(kind snippetKind, fragment *gabs.Container, logicalID string) (*gabs.Container, error) {
+	resource := fragment.Data()
+	if kind == snippetProperties {
+		resource = map[string]interface{}{
+			"Type":       "AWS::ECS::TaskDefinition",
+			"Properties": fragment.Data(),
+		}
+	}
+	template := gabs.New()
+	_, err := template.Set(resource, "Resources", logicalID)
+	if err != nil {
+		return nil, fmt.Errorf("could not wrap snippet: %w", err)
+	}
+	return template, nil
+}
+
+// unwrapSnippet extracts the patched snippet from the template built by wrapSnippet
+func unwrapSnippet(kind snippetKind, template *gabs.Container, logicalID string) ([]byte, error) {
+	if template.Exists("Conditions") {
+		return nil, fmt.Errorf("sidecars of %s need a new template condition, which cannot be declared from a snippet transform", logicalID)
+	}
+	if kind == snippetProperties {
+		return template.S("Resources", logicalID, "Properties").Bytes(), nil
+	}
+	return template.S("Resources", logicalID).Bytes(), nil
+}
+
+// TransformParameterOptIn and the following constants are the Parameters accepted through Fn::Transform
+const TransformParameterOptIn = "OptIn"
+const TransformParameterRecipe = "Recipe"
+const TransformParameterConfig = "Config"
+const TransformParameterLogicalID = "LogicalId"
+
+// ApplyTransformParameters reads the Parameters given to the macro through Fn::Transform into the configuration.
+// Config is deep merged over the recipe config and can be either an object or its JSON serialization.
+func (c *Configuration) ApplyTransformParameters(params []byte) error {
+	if len(params) == 0 {
+		return nil
+	}
+	parsed, err := gabs.ParseJSON(params)
+	if err != nil {
+		return fmt.Errorf("could not parse transform parameters: %w", err)
+	}
+	if parsed.Data() == nil {
+		return nil
+	}
+	values, ok := parsed.Data().(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("transform parameters must be an object")
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	problems := make([]string, 0)
+	for _, key := range keys {
+		value := values[key]
+		var err error
+		switch key {
+		case TransformParameterOptIn:
+			c.OptIn, err = transformBool(value)
+		case TransformParameterRecipe:
+			err = c.applyTransformRecipe(value)
+		case TransformParameterConfig:
+			err = c.applyTransformConfig(value)
+		case TransformParameterLogicalID:
+			name, isString := value.(string)
+			if !isString || name == "" {
+				err = fmt.Errorf("expected a non empty string")
+			}
+			c.SnippetLogicalID = name
+		default:
+			err = fmt.Errorf("unknown parameter")
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", key, err))
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid transform parameters: %s", strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+func transformBool(value interface{}) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("expected a boolean, got %q", v)
+		}
+		return b, nil
+	default:
+		return false, fmt.Errorf("expected a boolean, got %v", value)
+	}
+}
+
+// applyTransformRecipe makes the named recipe of the catalog the default one for this invocation
+func (c *Configuration) applyTransformRecipe(value interface{}) error {
+	name, ok := value.(string)
+	if !ok || name == "" {
+		return fmt.Errorf("expected a non empty string")
+	}
+	definition, err := c.recipe(name)
+	if err != nil {
+		return err
+	}
+	c.Kilt = definition
+	c.DefaultRecipe = name
+	return nil
+}
+
+func (c *Configuration) applyTransformConfig(value interface{}) error {
+	if s, isString := value.(string); isString {
+		err := json.Unmarshal([]byte(s), &value)
+		if err != nil {
+			return fmt.Errorf("could not parse config: %w", err)
+		}
+	}
+	overrides, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("expected an object")
+	}
+	merged, err := mergeRecipeConfig(c.RecipeConfig, overrides)
+	if err != nil {
+		return err
+	}
+	c.RecipeConfig = merged
+	return nil
+}
@@ -2,13 +2,15 @@ package cfnpatcher
 
 import (
 	"context"
-	"os"
+	"strings"
 
 	"github.com/Jeffail/gabs/v2"
 	"github.com/rs/zerolog/log"
 )
 
-func fillContainerInfo(ctx context.Context, container *gabs.Container, parameters *gabs.Container, configuration *Configuration) {
+// fillContainerInfo sets the entrypoint and command of container from the config of its image for platform, unless
+// the task definition overrides them
+func fillContainerInfo(ctx context.Context, container *gabs.Container, platform string, eval *evaluator, configuration *Configuration) {
 	l := log.Ctx(ctx)
 
 	hasOverriddenEntrypoint := container.Exists("EntryPoint")
@@ -18,35 +20,29 @@ func fillContainerInfo(ctx context.Context, container *gabs.Container, parameter
 		return
 	}
 
-	if !container.Exists("Image") {
+	image, hasImage, err := containerImage(container, eval)
+	if err != nil {
+		l.Warn().Str("image", container.S("Image").String()).Err(err).Msg("could not resolve the image")
 		return
 	}
-
-	var image string
-	if container.Exists("Image", "Ref") {
-		l.Info().Str("image", container.S("Image").String()).Msg("retrieving image from template parameters")
-
-		parameterName, ok := container.S("Image", "Ref").Data().(string)
-		if ok {
-			image, ok := parameters.S(parameterName).Data().(string)
-			if ok {
-				l.Info().Str("image", container.S("Image").String()).Msgf("found image %s", image)
-			} else {
-				l.Warn().Str("image", container.S("Image").String()).Msg("could not resolve the image parameter")
-			}
-		} else {
-			l.Warn().Str("image", container.S("Image").String()).Msg("could not find the name of the image parameter")
-		}
-	} else {
-		image = container.S("Image").Data().(string)
+	if !hasImage {
+		return
+	}
+	if _, isLiteral := container.S("Image").Data().(string); !isLiteral {
+		l.Info().Str("image", container.S("Image").String()).Msgf("resolved image %s", image)
 	}
 
 	if configuration.UseRepositoryHints {
-		os.Setenv("HOME", "/tmp") // crane requires $HOME variable
-		repoInfo, err := GetConfigFromRepository(image)
-		if err != nil {
-			l.Warn().Str("image", image).Err(err).Msg("could not retrieve metadata from repository")
+		// images were looked up ahead of patching, what is still unknown was not retrieved in time
+		repoInfo, found, err := configuration.hintCache().Peek(ImageLookup{image, platform})
+		if !found {
+			l.Warn().Str("image", image).Str("platform", platform).Msg("could not retrieve metadata from repository in time")
+		} else if err != nil {
+			l.Warn().Str("image", image).Str("platform", platform).Err(err).Msg("could not retrieve metadata from repository")
 		} else {
+			if repoInfo.Platform != "" && repoInfo.Platform != platform && !strings.HasPrefix(repoInfo.Platform, platform+"/") {
+				l.Warn().Str("image", image).Str("platform", platform).Msgf("image is built for %s", repoInfo.Platform)
+			}
 			// Use the image's entrypoint if the task definition does not override it
 			if repoInfo.Entrypoint != nil && !hasOverriddenEntrypoint {
 				l.Info().Str("image", container.S("Image").String()).Msgf("using default entrypoint %s", repoInfo.Entrypoint)
@@ -60,3 +56,30 @@ func fillContainerInfo(ctx context.Context, container *gabs.Container, parameter
 		}
 	}
 }
+
+// peekImageConfig returns the config of the image of container for platform, or nil when repository hints are
+// disabled or it is not known
+func peekImageConfig(container *gabs.Container, platform string, eval *evaluator, configuration *Configuration) *ImageConfig {
+	if !configuration.UseRepositoryHints {
+		return nil
+	}
+	image, hasImage, err := containerImage(container, eval)
+	if err != nil || !hasImage {
+		return nil
+	}
+	imageConfig, found, err := configuration.hintCache().Peek(ImageLookup{image, platform})
+	if !found || err != nil {
+		return nil
+	}
+	return imageConfig
+}
+
+// imageConfigValues returns the config of the image of container for platform, as exposed to definitions in
+// original.image_config, or nil when it is not known
+func imageConfigValues(container *gabs.Container, platform string, eval *evaluator, configuration *Configuration) map[string]interface{} {
+	imageConfig := peekImageConfig(container, platform, eval, configuration)
+	if imageConfig == nil {
+		return nil
+	}
+	return imageConfig.hoconValues()
+}
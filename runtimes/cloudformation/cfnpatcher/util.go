@@ -2,28 +2,72 @@ package cfnpatcher
 
 import (
 	"fmt"
+
 	"github.com/Jeffail/gabs/v2"
 )
 
-func getOptTags(template *gabs.Container) map[string]string {
+func getOptTags(template *gabs.Container, eval *evaluator) (map[string]string, error) {
 	optTags := make(map[string]string)
 	if !template.Exists("Properties", "Tags") {
-		return optTags
+		return optTags, nil
 	}
-	for _, tag := range template.S("Properties", "Tags").Children() {
+	for _, rawTag := range template.S("Properties", "Tags").Children() {
+		tag := rawTag
+		if !rawTag.Exists("Key") {
+			// whole tags can be conditional, e.g. Fn::If [cond, {Key, Value}, Ref AWS::NoValue]
+			evaluated, err := eval.evaluate(rawTag.Data(), 0)
+			if err != nil {
+				if mentionsOptTag(rawTag.Data()) {
+					return nil, fmt.Errorf("could not evaluate tag %s: %w", rawTag.String(), err)
+				}
+				continue
+			}
+			tag = gabs.Wrap(evaluated)
+		}
 		if tag.Exists("Key") && tag.Exists("Value") {
-			k, ok := tag.S("Key").Data().(string)
-			if !ok {
-				panic(fmt.Errorf("tag has an unsupported key type: %s", tag.String()))
+			k, err := eval.resolveString(tag.S("Key"))
+			if err != nil {
+				// tags with computed keys cannot be told apart, they are not opt tags in any sensible template
+				continue
 			}
 			if isOptTagKey(k) {
-				v, ok := tag.S("Value").Data().(string)
+				value, err := eval.evaluate(tag.S("Value").Data(), 0)
+				if err != nil {
+					return nil, fmt.Errorf("OptIn/OptOut tag %s has a value that cannot be evaluated: %w", k, err)
+				}
+				if isNoValue(value) {
+					continue
+				}
+				v, ok := toString(value)
 				if !ok {
-					panic(fmt.Errorf("OptIn/OptOut tag %s has an unsupported value type: %s", k, v))
+					return nil, fmt.Errorf("OptIn/OptOut tag %s has an unsupported value type: %s", k, tag.S("Value").String())
 				}
 				optTags[k] = v
 			}
 		}
 	}
-	return optTags
+	return optTags, nil
+}
+
+// mentionsOptTag reports whether an unevaluated tag could be a kilt tag, tags that cannot be evaluated only matter
+// then
+func mentionsOptTag(data interface{}) bool {
+	switch v := data.(type) {
+	case map[string]interface{}:
+		if key, ok := v["Key"].(string); ok && isOptTagKey(key) {
+			return true
+		}
+		for _, child := range v {
+			if mentionsOptTag(child) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			if mentionsOptTag(child) {
+				return true
+			}
+		}
+	}
+	return false
 }
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -12,31 +13,83 @@ import (
 )
 
 func main() {
-	if len(os.Args) != 3 {
-		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s KILT_DEFINITION TEMPLATE\n", os.Args[0])
+	parametersFile := flag.String("parameters", "", "JSON file with template parameter values")
+	hintsCache := flag.String("hints-cache", "", "directory caching image metadata used as repository hints, disabled when empty")
+	hintsTimeout := flag.Duration("hints-timeout", cfnpatcher.DefaultHintTimeout, "time allowed to retrieve image metadata")
+	hintsConcurrency := flag.Int("hints-concurrency", cfnpatcher.DefaultHintWorkers, "concurrent image metadata lookups")
+	imageCatalog := flag.String("image-catalog", "", "image metadata catalog, built with cfn-image-catalog, consulted before registries")
+	offline := flag.Bool("offline", false, "never access registries, only images of the -image-catalog are known")
+	pinImages := flag.String("pin-images", string(cfnpatcher.ImagePinningNone), "images replaced by their digest: none, sidecars or all")
+	pinFailurePolicy := flag.String("pin-failure-policy", string(cfnpatcher.PinFailureKeepTag), "what happens to images that cannot be pinned: keep-tag or fail")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s [-parameters FILE] [-hints-cache DIR] [-hints-timeout DURATION] [-hints-concurrency N] [-image-catalog FILE] [-offline] [-pin-images MODE] [-pin-failure-policy POLICY] KILT_DEFINITION TEMPLATE\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
 		return
 	}
-	kiltDef, err := ioutil.ReadFile(os.Args[1])
+	kiltDef, err := ioutil.ReadFile(flag.Arg(0))
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Cannot read kilt definition %s: %s\n", os.Args[1], err)
+		_, _ = fmt.Fprintf(os.Stderr, "Cannot read kilt definition %s: %s\n", flag.Arg(0), err)
 		return
 	}
 
-	template, err := ioutil.ReadFile(os.Args[2])
+	template, err := ioutil.ReadFile(flag.Arg(1))
 	if err != nil {
-		_, _ = fmt.Fprintf(os.Stderr, "Cannot read template %s: %s\n", os.Args[2], err)
+		_, _ = fmt.Fprintf(os.Stderr, "Cannot read template %s: %s\n", flag.Arg(1), err)
 		return
 	}
 
+	templateParameters := make([]byte, 0)
+	if *parametersFile != "" {
+		rawParameters, err := ioutil.ReadFile(*parametersFile)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Cannot read parameters %s: %s\n", *parametersFile, err)
+			return
+		}
+		templateParameters, err = cfnpatcher.ParseParametersFile(rawParameters)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Cannot parse parameters %s: %s\n", *parametersFile, err)
+			return
+		}
+	}
+
+	pinning, err := cfnpatcher.ParseImagePinning(*pinImages)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Invalid -pin-images: %s\n", err)
+		return
+	}
+	pinPolicy, err := cfnpatcher.ParsePinFailurePolicy(*pinFailurePolicy)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Invalid -pin-failure-policy: %s\n", err)
+		return
+	}
+
+	hintCache := &cfnpatcher.HintCache{Dir: *hintsCache, Offline: *offline}
+	if *imageCatalog != "" {
+		hintCache.Catalog, err = cfnpatcher.LoadImageCatalog(*imageCatalog)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Cannot read image catalog %s: %s\n", *imageCatalog, err)
+			return
+		}
+	}
+
 	config := &cfnpatcher.Configuration{
 		Kilt:               string(kiltDef),
 		OptIn:              false,
 		UseRepositoryHints: true,
+		HintCache:          hintCache,
+		HintWorkers:        *hintsConcurrency,
+		HintTimeout:        *hintsTimeout,
+		ImagePinning:       pinning,
+		PinFailurePolicy:   pinPolicy,
 	}
 	ctx := context.Background()
 	l := zerolog.New(os.Stderr).With().Timestamp().Logger()
 	ctx = l.WithContext(ctx)
-	templateParameters := make([]byte, 0)
 	result, err := cfnpatcher.Patch(ctx, config, template, templateParameters)
 
 	if err != nil {
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sysdiglabs/agent-kilt/runtimes/cloudformation/cfnpatcher"
+)
+
+func main() {
+	output := flag.String("o", "image-catalog.json", "catalog to write, images already in it are kept unless looked up again")
+	platforms := flag.String("platform", cfnpatcher.DefaultPlatform, "comma separated platforms to look images up for, e.g. linux/amd64,linux/arm64")
+	imagesFile := flag.String("images", "", "file listing images, one per line, - reads them from stdin")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s [-o FILE] [-platform OS/ARCH,...] [-images FILE] [IMAGE...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	images := flag.Args()
+	if *imagesFile != "" {
+		listed, err := readImages(*imagesFile)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Cannot read images %s: %s\n", *imagesFile, err)
+			os.Exit(1)
+		}
+		images = append(images, listed...)
+	}
+	if len(images) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	catalog, err := cfnpatcher.LoadImageCatalog(*output)
+	if errors.Is(err, os.ErrNotExist) {
+		catalog, err = &cfnpatcher.ImageCatalog{}, nil
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Cannot read catalog: %s\n", err)
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, image := range images {
+		for _, platform := range strings.Split(*platforms, ",") {
+			platform = strings.TrimSpace(platform)
+			config, err := cfnpatcher.FetchImageConfig(context.Background(), image, platform, nil)
+			if err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "%s\n", err)
+				failed = true
+				continue
+			}
+			catalog.Add(image, platform, config)
+			_, _ = fmt.Fprintf(os.Stderr, "%s (%s): %s\n", image, config.Platform, config.Digest)
+		}
+	}
+
+	err = catalog.Save(*output)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Cannot write catalog %s: %s\n", *output, err)
+		os.Exit(1)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// readImages lists the images of path, ignoring blank lines and # comments
+func readImages(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	images := make([]string, 0)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			images = append(images, line)
+		}
+	}
+	return images, scanner.Err()
+}
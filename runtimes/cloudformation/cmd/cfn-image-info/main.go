@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
 
@@ -8,14 +10,22 @@ import (
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		println("needs 1 argument: image")
+	platform := flag.String("platform", cfnpatcher.DefaultPlatform, "platform picked from multi-platform images, e.g. linux/arm64")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: %s [-platform OS/ARCH] IMAGE\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
 		return
 	}
 
-	res, err := cfnpatcher.GetConfigFromRepository(os.Args[1])
+	res, err := cfnpatcher.FetchImageConfig(context.Background(), flag.Arg(0), *platform, nil)
 	if err != nil {
 		panic(err)
 	}
+	fmt.Printf("platform: %s\n", res.Platform)
 	fmt.Printf("%+v\n", res)
 }
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/rs/zerolog/log"
+
+	"github.com/sysdiglabs/agent-kilt/runtimes/cloudformation/cfnpatcher"
+	"github.com/sysdiglabs/agent-kilt/runtimes/cloudformation/config"
+)
+
+// RecipeSource tells where a recipe of the KILT_RECIPES catalog is loaded from, Type and Definition have the same
+// meaning as KILT_DEFINITION_TYPE and KILT_DEFINITION
+type RecipeSource struct {
+	Type       string `json:"type"`
+	Definition string `json:"definition"`
+	// SHA256 and Signature have the same meaning as KILT_DEFINITION_SHA256 and KILT_DEFINITION_SIGNATURE
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+var registerSources sync.Once
+
+// hintCache keeps repository hints across invocations, it is created along the sources
+var hintCache *cfnpatcher.HintCache
+
+// loadDefinition loads KILT_DEFINITION. When it is an OCI artifact and withConfig is set, the recipe config shipped
+// along is read from the same manifest, which integrity covers, and returned as well.
+func loadDefinition(ctx context.Context, definitionType, definition string, integrity *config.Integrity, withConfig bool) (string, string, error) {
+	uri, err := config.DefinitionURI(definitionType, definition)
+	if err == nil && withConfig && strings.HasPrefix(uri, config.OCI+"://") && !strings.Contains(uri, "#") {
+		return config.LoadArtifact(ctx, uri, integrity)
+	}
+	loaded, err := config.Load(ctx, definitionType, definition, integrity)
+	return loaded, "", err
+}
+
+// GetConfig reads and validates the KILT_* environment variables. Every invalid variable is reported at once in a
+// *config.ValidationError.
+func GetConfig(ctx context.Context) (*cfnpatcher.Configuration, error) {
+	definition := os.Getenv("KILT_DEFINITION")
+	definitionType := os.Getenv("KILT_DEFINITION_TYPE")
+	optIn := os.Getenv("KILT_OPT_IN")
+	imageAuth := os.Getenv("KILT_IMAGE_AUTH_SECRET")
+	recipeConfig := os.Getenv("KILT_RECIPE_CONFIG")
+	disableRepoHints := os.Getenv("KILT_DISABLE_REPO_HINTS")
+	repoHintsTimeout := os.Getenv("KILT_REPO_HINTS_TIMEOUT")
+	repoHintsConcurrency := os.Getenv("KILT_REPO_HINTS_CONCURRENCY")
+	pinImages := os.Getenv("KILT_PIN_IMAGES")
+	pinFailurePolicy := os.Getenv("KILT_PIN_FAILURE_POLICY")
+	logGroup := os.Getenv("KILT_LOG_GROUP")
+	parameterizeEnvars := os.Getenv("KILT_PARAMETERIZE_ENVARS")
+	sidecarEssential := os.Getenv("KILT_SIDECAR_ESSENTIAL")
+	sidecarCpu := os.Getenv("KILT_SIDECAR_CPU")
+	sidecarMemoryLimit := os.Getenv("KILT_SIDECAR_MEMORY_LIMIT")
+	sidecarMemoryReservation := os.Getenv("KILT_SIDECAR_MEMORY_RESERVATION")
+	sidecarConfig := os.Getenv("KILT_SIDECAR_CONFIG")
+	failurePolicy := os.Getenv("KILT_FAILURE_POLICY")
+	selectionRules := os.Getenv("KILT_SELECTION_RULES")
+	recipes := os.Getenv("KILT_RECIPES")
+	defaultRecipe := os.Getenv("KILT_DEFAULT_RECIPE")
+	definitionSHA256 := os.Getenv("KILT_DEFINITION_SHA256")
+	definitionPublicKey := os.Getenv("KILT_DEFINITION_PUBLIC_KEY")
+	definitionSignature := os.Getenv("KILT_DEFINITION_SIGNATURE")
+
+	problems := &config.ValidationError{}
+
+	// definitions are only loaded after every source is set up. Sources are registered once so that what they
+	// cached to revalidate definitions survives reloads.
+	webSource := webSourceFromEnv(problems)
+	s3Source := s3SourceFromEnv(problems)
+	keychain := registryKeychainFromEnv(problems, imageAuth)
+	registerSources.Do(func() {
+		config.Register("http", webSource("http"))
+		config.Register("https", webSource("https"))
+		config.Register("s3", s3Source)
+		config.Register("oci", &config.OCISource{Keychain: keychain})
+		hintCache = &cfnpatcher.HintCache{Keychain: keychain}
+	})
+
+	_, err := reloadTTLFromEnv()
+	problems.Add("KILT_RELOAD_TTL", err)
+
+	// the public key applies to every definition, nothing is loaded when it is broken so that verification can
+	// never be skipped
+	var keyErr error
+	if definitionPublicKey != "" {
+		_, keyErr = config.ParsePublicKey([]byte(definitionPublicKey))
+		problems.Add("KILT_DEFINITION_PUBLIC_KEY", keyErr)
+	}
+
+	var fullDefinition string
+	if keyErr == nil && (definitionType != "" || definition != "" || defaultRecipe == "") {
+		integrity, err := config.NewIntegrity(definitionSHA256, definitionPublicKey, definitionSignature)
+		if err != nil {
+			problems.Add("KILT_DEFINITION_SHA256", err)
+		} else {
+			var artifactConfig string
+			fullDefinition, artifactConfig, err = loadDefinition(ctx, definitionType, definition, integrity, recipeConfig == "")
+			variable := "KILT_DEFINITION"
+			if errors.Is(err, config.ErrUnknownType) {
+				variable = "KILT_DEFINITION_TYPE"
+			}
+			problems.Add(variable, err)
+			if recipeConfig == "" {
+				recipeConfig = artifactConfig
+			}
+		}
+	}
+
+	var catalog map[string]RecipeSource
+	if recipes != "" {
+		err := json.Unmarshal([]byte(recipes), &catalog)
+		problems.Add("KILT_RECIPES", err)
+	}
+	names := make([]string, 0, len(catalog))
+	for name := range catalog {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	recipeDefinitions := make(map[string]string)
+	for _, name := range names {
+		if keyErr != nil {
+			break
+		}
+		source := catalog[name]
+		integrity, err := config.NewIntegrity(source.SHA256, definitionPublicKey, source.Signature)
+		if err == nil {
+			recipeDefinitions[name], err = config.Load(ctx, source.Type, source.Definition, integrity)
+		}
+		if err != nil {
+			problems.Add("KILT_RECIPES", fmt.Errorf("recipe %s: %w", name, err))
+		}
+	}
+	if _, ok := catalog[defaultRecipe]; defaultRecipe != "" && !ok {
+		problems.Add("KILT_DEFAULT_RECIPE", fmt.Errorf("recipe %s is not in the recipe catalog", defaultRecipe))
+	}
+
+	if recipeConfig != "" && !json.Valid([]byte(recipeConfig)) {
+		problems.Add("KILT_RECIPE_CONFIG", fmt.Errorf("expected a JSON document"))
+	}
+
+	// any value selects opt-in, as it always did, installs setting it to yes or enabled keep working
+	optInEnabled := optIn != ""
+	if disabled, err := strconv.ParseBool(optIn); err == nil && !disabled {
+		log.Warn().Str("value", optIn).Msg("KILT_OPT_IN is set, which selects opt-in whatever its value, unset it for opt-out")
+	}
+	parameterize := parseBoolean(problems, "KILT_PARAMETERIZE_ENVARS", parameterizeEnvars)
+
+	scObj := gabs.New()
+	if sidecarConfig != "" {
+		sc, err := gabs.ParseJSON([]byte(sidecarConfig))
+		if err == nil {
+			if _, isObject := sc.Data().(map[string]interface{}); !isObject {
+				err = fmt.Errorf("expected a JSON object")
+			}
+		}
+		if err != nil {
+			problems.Add("KILT_SIDECAR_CONFIG", err)
+		} else {
+			scObj = sc
+		}
+	}
+
+	if imageAuth != "" {
+		_, err := scObj.Set(imageAuth, "RepositoryCredentials", "CredentialsParameter")
+		problems.Add("KILT_IMAGE_AUTH_SECRET", err)
+	}
+
+	if sidecarEssential != "" {
+		essential := parseBoolean(problems, "KILT_SIDECAR_ESSENTIAL", sidecarEssential)
+		_, err := scObj.Set(essential, "Essential")
+		problems.Add("KILT_SIDECAR_ESSENTIAL", err)
+	}
+
+	if sidecarCpu != "" {
+		problems.Add("KILT_SIDECAR_CPU", validateUnits(sidecarCpu, 0))
+		_, err := scObj.Set(sidecarCpu, "Cpu")
+		problems.Add("KILT_SIDECAR_CPU", err)
+	}
+
+	if sidecarMemoryLimit != "" {
+		problems.Add("KILT_SIDECAR_MEMORY_LIMIT", validateUnits(sidecarMemoryLimit, 1))
+		_, err := scObj.Set(sidecarMemoryLimit, "Memory")
+		problems.Add("KILT_SIDECAR_MEMORY_LIMIT", err)
+	}
+
+	if sidecarMemoryReservation != "" {
+		problems.Add("KILT_SIDECAR_MEMORY_RESERVATION", validateUnits(sidecarMemoryReservation, 1))
+		_, err := scObj.Set(sidecarMemoryReservation, "MemoryReservation")
+		problems.Add("KILT_SIDECAR_MEMORY_RESERVATION", err)
+	}
+
+	if sidecarMemoryLimit != "" && sidecarMemoryReservation != "" {
+		limit, limitErr := strconv.Atoi(sidecarMemoryLimit)
+		reservation, reservationErr := strconv.Atoi(sidecarMemoryReservation)
+		if limitErr == nil && reservationErr == nil && reservation > limit {
+			problems.Add("KILT_SIDECAR_MEMORY_RESERVATION", fmt.Errorf("%d exceeds KILT_SIDECAR_MEMORY_LIMIT %d", reservation, limit))
+		}
+	}
+
+	sc, err := json.Marshal(scObj)
+	problems.Add("KILT_SIDECAR_CONFIG", err)
+
+	policy, err := cfnpatcher.ParseFailurePolicy(failurePolicy)
+	problems.Add("KILT_FAILURE_POLICY", err)
+
+	pinning, err := cfnpatcher.ParseImagePinning(pinImages)
+	problems.Add("KILT_PIN_IMAGES", err)
+	pinPolicy, err := cfnpatcher.ParsePinFailurePolicy(pinFailurePolicy)
+	problems.Add("KILT_PIN_FAILURE_POLICY", err)
+
+	rules, err := cfnpatcher.ParseSelectionRules(selectionRules)
+	problems.Add("KILT_SELECTION_RULES", err)
+
+	var hintTimeout time.Duration
+	if repoHintsTimeout != "" {
+		hintTimeout, err = time.ParseDuration(repoHintsTimeout)
+		if err == nil && hintTimeout <= 0 {
+			err = fmt.Errorf("expected a positive duration")
+		}
+		problems.Add("KILT_REPO_HINTS_TIMEOUT", err)
+	}
+	var hintWorkers int
+	if repoHintsConcurrency != "" {
+		hintWorkers, err = strconv.Atoi(repoHintsConcurrency)
+		if err == nil && hintWorkers <= 0 {
+			err = fmt.Errorf("expected at least 1")
+		}
+		problems.Add("KILT_REPO_HINTS_CONCURRENCY", err)
+	}
+
+	if err := problems.Err(); err != nil {
+		return nil, err
+	}
+
+	configuration := &cfnpatcher.Configuration{
+		Kilt:               fullDefinition,
+		OptIn:              optInEnabled,
+		RecipeConfig:       recipeConfig,
+		UseRepositoryHints: disableRepoHints == "",
+		LogGroup:           logGroup,
+		ParameterizeEnvars: parameterize,
+		SidecarConfig:      string(sc),
+		FailurePolicy:      policy,
+		SelectionRules:     rules,
+		Recipes:            recipeDefinitions,
+		DefaultRecipe:      defaultRecipe,
+		HintCache:          hintCache,
+		HintWorkers:        hintWorkers,
+		HintTimeout:        hintTimeout,
+		ImagePinning:       pinning,
+		PinFailurePolicy:   pinPolicy,
+	}
+
+	return configuration, nil
+}
+
+// registryKeychainFromEnv reads KILT_REGISTRY_AUTH, a JSON list of config.RegistryAuthRule. Secrets Manager rules
+// without a secret use KILT_IMAGE_AUTH_SECRET, the credentials of the sidecar images. Registries matched by no rule
+// are accessed anonymously.
+func registryKeychainFromEnv(problems *config.ValidationError, imageAuth string) *config.RegistryKeychain {
+	rules, err := config.ParseRegistryAuthRules(os.Getenv("KILT_REGISTRY_AUTH"), imageAuth)
+	problems.Add("KILT_REGISTRY_AUTH", err)
+	return &config.RegistryKeychain{Rules: rules}
+}
+
+// webSourceFromEnv reads the KILT_HTTP_* variables and returns a constructor of web sources configured with them
+func webSourceFromEnv(problems *config.ValidationError) func(scheme string) *config.WebSource {
+	timeout := os.Getenv("KILT_HTTP_TIMEOUT")
+	retries := os.Getenv("KILT_HTTP_RETRIES")
+	maxBodySize := os.Getenv("KILT_HTTP_MAX_BODY_SIZE")
+	authType := os.Getenv("KILT_HTTP_AUTH_TYPE")
+	authToken := os.Getenv("KILT_HTTP_AUTH_TOKEN")
+	authSecret := os.Getenv("KILT_HTTP_AUTH_SECRET")
+	authURLPrefix := os.Getenv("KILT_HTTP_AUTH_URL_PREFIX")
+
+	template := config.WebSource{}
+	if timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err == nil && d <= 0 {
+			err = fmt.Errorf("expected a positive duration")
+		}
+		problems.Add("KILT_HTTP_TIMEOUT", err)
+		template.Timeout = d
+	}
+	if retries != "" {
+		n, err := strconv.Atoi(retries)
+		if err == nil && n < 0 {
+			err = fmt.Errorf("expected at least 0")
+		}
+		problems.Add("KILT_HTTP_RETRIES", err)
+		template.Retries = n
+		if n == 0 {
+			template.Retries = -1
+		}
+	}
+	if maxBodySize != "" {
+		n, err := strconv.ParseInt(maxBodySize, 10, 64)
+		if err == nil && n <= 0 {
+			err = fmt.Errorf("expected a positive number of bytes")
+		}
+		problems.Add("KILT_HTTP_MAX_BODY_SIZE", err)
+		template.MaxBodySize = n
+	}
+
+	var auth *config.WebAuth
+	switch strings.ToLower(authType) {
+	case "":
+		if authToken != "" || authSecret != "" || authURLPrefix != "" {
+			problems.Add("KILT_HTTP_AUTH_TYPE", fmt.Errorf("required with KILT_HTTP_AUTH_TOKEN, KILT_HTTP_AUTH_SECRET or KILT_HTTP_AUTH_URL_PREFIX"))
+		}
+	case config.AuthBearer, config.AuthBasic:
+		if (authToken == "") == (authSecret == "") {
+			problems.Add("KILT_HTTP_AUTH_TYPE", fmt.Errorf("requires exactly one of KILT_HTTP_AUTH_TOKEN or KILT_HTTP_AUTH_SECRET"))
+		}
+		if authURLPrefix == "" {
+			problems.Add("KILT_HTTP_AUTH_URL_PREFIX", fmt.Errorf("required with KILT_HTTP_AUTH_TYPE, credentials are only sent under it"))
+		} else {
+			problems.Add("KILT_HTTP_AUTH_URL_PREFIX", config.ValidateURLPrefix(authURLPrefix))
+		}
+		auth = &config.WebAuth{URLPrefix: authURLPrefix, Type: authType, Secret: authToken, SecretURI: authSecret}
+	default:
+		problems.Add("KILT_HTTP_AUTH_TYPE", fmt.Errorf("expected %s or %s", config.AuthBearer, config.AuthBasic))
+	}
+
+	return func(scheme string) *config.WebSource {
+		return &config.WebSource{
+			Scheme:      scheme,
+			Timeout:     template.Timeout,
+			Retries:     template.Retries,
+			MaxBodySize: template.MaxBodySize,
+			Auth:        auth,
+		}
+	}
+}
+
+// s3SourceFromEnv reads the KILT_S3_* variables
+func s3SourceFromEnv(problems *config.ValidationError) *config.S3Source {
+	region := os.Getenv("KILT_S3_REGION")
+	endpoint := os.Getenv("KILT_S3_ENDPOINT")
+	forcePathStyle := os.Getenv("KILT_S3_FORCE_PATH_STYLE")
+	maxSize := os.Getenv("KILT_S3_MAX_SIZE")
+
+	source := &config.S3Source{
+		Region:   region,
+		Endpoint: endpoint,
+	}
+	if forcePathStyle != "" {
+		b, err := strconv.ParseBool(forcePathStyle)
+		problems.Add("KILT_S3_FORCE_PATH_STYLE", expectBoolean(err))
+		source.ForcePathStyle = b
+	}
+	if maxSize != "" {
+		n, err := strconv.ParseInt(maxSize, 10, 64)
+		if err == nil && n <= 0 {
+			err = fmt.Errorf("expected a positive number of bytes")
+		}
+		problems.Add("KILT_S3_MAX_SIZE", err)
+		source.MaxSize = n
+	}
+	return source
+}
+
+// parseBoolean reads a boolean variable as strconv.ParseBool does, unset is false
+func parseBoolean(problems *config.ValidationError, variable string, value string) bool {
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	problems.Add(variable, expectBoolean(err))
+	return b
+}
+
+func expectBoolean(err error) error {
+	if err != nil {
+		return fmt.Errorf("expected true or false")
+	}
+	return nil
+}
+
+// validateUnits checks CPU units and MiB of memory, which are integers of at least min
+func validateUnits(value string, min int) error {
+	units, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("expected an integer, got %q", value)
+	}
+	if units < min {
+		return fmt.Errorf("expected at least %d, got %d", min, units)
+	}
+	return nil
+}
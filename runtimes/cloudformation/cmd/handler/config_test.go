@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/Jeffail/gabs/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/sysdiglabs/agent-kilt/runtimes/cloudformation/config"
+)
+
+const testDefinition = `build {
+    entry_point: ["/kilt/run", "--", ${?original.entry_point}]
+    command: ${?original.command}
+}`
+
+func setDefinition(t *testing.T) {
+	t.Setenv("KILT_DEFINITION_TYPE", config.Base64)
+	t.Setenv("KILT_DEFINITION", base64.StdEncoding.EncodeToString([]byte(testDefinition)))
+}
+
+func TestGetConfigReportsEveryInvalidVariable(t *testing.T) {
+	setDefinition(t)
+	t.Setenv("KILT_PARAMETERIZE_ENVARS", "yes")
+	t.Setenv("KILT_SIDECAR_ESSENTIAL", "no")
+	t.Setenv("KILT_SIDECAR_CPU", "abc")
+	t.Setenv("KILT_FAILURE_POLICY", "bogus")
+
+	_, err := GetConfig(context.Background())
+	var problems *config.ValidationError
+	require.True(t, errors.As(err, &problems), "expected a validation error, got %v", err)
+
+	variables := make([]string, 0, len(problems.Errors))
+	for _, problem := range problems.Errors {
+		variables = append(variables, problem.Variable)
+	}
+	assert.ElementsMatch(t, []string{
+		"KILT_PARAMETERIZE_ENVARS",
+		"KILT_SIDECAR_ESSENTIAL",
+		"KILT_SIDECAR_CPU",
+		"KILT_FAILURE_POLICY",
+	}, variables)
+}
+
+func TestGetConfigBooleans(t *testing.T) {
+	setDefinition(t)
+	t.Setenv("KILT_PARAMETERIZE_ENVARS", "1")
+	t.Setenv("KILT_SIDECAR_ESSENTIAL", "F")
+
+	configuration, err := GetConfig(context.Background())
+	require.NoError(t, err)
+	assert.False(t, configuration.OptIn)
+	assert.True(t, configuration.ParameterizeEnvars)
+
+	sidecar, err := gabs.ParseJSON([]byte(configuration.SidecarConfig))
+	require.NoError(t, err)
+	assert.Equal(t, false, sidecar.S("Essential").Data())
+
+	// KILT_OPT_IN keeps selecting opt-in whatever its value
+	for _, value := range []string{"true", "yes", "enabled", "false"} {
+		t.Setenv("KILT_OPT_IN", value)
+		configuration, err = GetConfig(context.Background())
+		require.NoError(t, err)
+		assert.True(t, configuration.OptIn, value)
+	}
+}
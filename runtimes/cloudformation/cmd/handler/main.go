@@ -3,11 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"github.com/Jeffail/gabs/v2"
 	"os"
-	"strings"
-
-	"github.com/sysdiglabs/agent-kilt/runtimes/cloudformation/config"
 
 	"github.com/sysdiglabs/agent-kilt/runtimes/cloudformation/cfnpatcher"
 
@@ -23,12 +19,24 @@ type MacroInput struct {
 	TransformID             string          `json:"transformId"`
 	TemplateParameterValues json.RawMessage `json:"templateParameterValues"`
 	Fragment                json.RawMessage `json:"fragment"`
+	Params                  json.RawMessage `json:"params"`
 }
 
 type MacroOutput struct {
-	RequestID string          `json:"requestId"`
-	Status    string          `json:"status"`
-	Fragment  json.RawMessage `json:"fragment"`
+	RequestID    string          `json:"requestId"`
+	Status       string          `json:"status"`
+	Fragment     json.RawMessage `json:"fragment"`
+	ErrorMessage string          `json:"errorMessage,omitempty"`
+}
+
+// failure builds the response of a failed transformation. CloudFormation shows errorMessage in the stack events,
+// which is more helpful than the generic message it shows for a failed invocation.
+func failure(requestID string, err error) MacroOutput {
+	return MacroOutput{
+		RequestID:    requestID,
+		Status:       "failure",
+		ErrorMessage: err.Error(),
+	}
 }
 
 func HandleRequest(configuration *cfnpatcher.Configuration, ctx context.Context, event MacroInput) (MacroOutput, error) {
@@ -39,15 +47,25 @@ func HandleRequest(configuration *cfnpatcher.Configuration, ctx context.Context,
 		Str("transformId", event.TransformID).
 		Logger()
 	loggerCtx := l.WithContext(ctx)
-	result, err := cfnpatcher.Patch(loggerCtx, configuration, event.Fragment, event.TemplateParameterValues)
+
+	invocation := *configuration
+	invocation.Region = event.Region
+	invocation.AccountID = event.AccountID
+	err := invocation.ApplyTransformParameters(event.Params)
+	if err != nil {
+		l.Error().Err(err).Msg("invalid transform parameters")
+		return failure(event.RequestID, err), nil
+	}
+	result, err := cfnpatcher.Patch(loggerCtx, &invocation, event.Fragment, event.TemplateParameterValues)
 	if err != nil {
-		return MacroOutput{event.RequestID, "failure", result}, err
+		l.Error().Err(err).Msg("processing failed")
+		return failure(event.RequestID, err), nil
 	}
 	log.Info().Str("template", string(result)).Msg("processing complete")
-	return MacroOutput{event.RequestID, "success", result}, nil
+	return MacroOutput{RequestID: event.RequestID, Status: "success", Fragment: result}, nil
 }
 
-func PatchLocalFile(configuration *cfnpatcher.Configuration, ctx context.Context, inputFile string) ([]byte, error) {
+func PatchLocalFile(configuration *cfnpatcher.Configuration, ctx context.Context, inputFile string, parametersFile string) ([]byte, error) {
 	l := log.With().
 		Str("region", "local").
 		Logger()
@@ -60,117 +78,39 @@ func PatchLocalFile(configuration *cfnpatcher.Configuration, ctx context.Context
 	}
 
 	templateParameters := make([]byte, 0)
-	result, err := cfnpatcher.Patch(loggerCtx, configuration, inputData, templateParameters)
-	if err != nil {
-		l.Error().Err(err).Msg("failed to patch local file")
-		return nil, err
-	}
-
-	log.Info().Str("template", string(result)).Msg("processing complete")
-	return result, nil
-}
-
-func GetConfig() *cfnpatcher.Configuration {
-	definition := os.Getenv("KILT_DEFINITION")
-	definitionType := os.Getenv("KILT_DEFINITION_TYPE")
-	optIn := os.Getenv("KILT_OPT_IN")
-	imageAuth := os.Getenv("KILT_IMAGE_AUTH_SECRET")
-	recipeConfig := os.Getenv("KILT_RECIPE_CONFIG")
-	disableRepoHints := os.Getenv("KILT_DISABLE_REPO_HINTS")
-	logGroup := os.Getenv("KILT_LOG_GROUP")
-	parameterizeEnvars := os.Getenv("KILT_PARAMETERIZE_ENVARS")
-	sidecarEssential := os.Getenv("KILT_SIDECAR_ESSENTIAL")
-	sidecarCpu := os.Getenv("KILT_SIDECAR_CPU")
-	sidecarMemoryLimit := os.Getenv("KILT_SIDECAR_MEMORY_LIMIT")
-	sidecarMemoryReservation := os.Getenv("KILT_SIDECAR_MEMORY_RESERVATION")
-	sidecarConfig := os.Getenv("KILT_SIDECAR_CONFIG")
-
-	var fullDefinition string
-	switch definitionType {
-	case config.S3:
-		fullDefinition = config.FromS3(definition, false)
-	case config.S3Gz:
-		fullDefinition = config.FromS3(definition, true)
-	case config.Http:
-		fullDefinition = config.FromWeb(definition)
-	case config.Base64:
-		fullDefinition = config.FromBase64(definition, false)
-	case config.Base64Gz:
-		fullDefinition = config.FromBase64(definition, true)
-	default:
-		panic("unrecognized definition type - " + definitionType)
-	}
-
-	scObj := gabs.New()
-	if sidecarConfig != "" {
-		sc, err := gabs.ParseJSON([]byte(sidecarConfig))
-		if err != nil {
-			panic("cannot parse sidecar config: " + err.Error())
-		}
-		scObj = sc
-	}
-
-	if imageAuth != "" {
-		_, err := scObj.Set(imageAuth, "RepositoryCredentials", "CredentialsParameter")
-		if err != nil {
-			panic("cannot set image auth secret in sidecar config: " + err.Error())
-		}
-	}
-
-	if sidecarEssential != "" {
-		_, err := scObj.Set(sidecarEssential, "Essential")
-		if err != nil {
-			panic("cannot set sidecar essential in sidecar config: " + err.Error())
-		}
-	}
-
-	if sidecarCpu != "" {
-		_, err := scObj.Set(sidecarCpu, "Cpu")
+	if parametersFile != "" {
+		rawParameters, err := os.ReadFile(parametersFile)
 		if err != nil {
-			panic("cannot set sidecar cpu in sidecar config: " + err.Error())
+			l.Error().Err(err).Msgf("cannot read file %s", parametersFile)
+			return nil, err
 		}
-	}
-
-	if sidecarMemoryLimit != "" {
-		_, err := scObj.Set(sidecarMemoryLimit, "Memory")
-		if err != nil {
-			panic("cannot set sidecar memory limit in sidecar config: " + err.Error())
-		}
-	}
-
-	if sidecarMemoryReservation != "" {
-		_, err := scObj.Set(sidecarMemoryReservation, "MemoryReservation")
+		templateParameters, err = cfnpatcher.ParseParametersFile(rawParameters)
 		if err != nil {
-			panic("cannot set sidecar memory reservation in sidecar config: " + err.Error())
+			l.Error().Err(err).Msgf("cannot parse parameters file %s", parametersFile)
+			return nil, err
 		}
 	}
 
-	sc, err := json.Marshal(scObj)
+	result, err := cfnpatcher.Patch(loggerCtx, configuration, inputData, templateParameters)
 	if err != nil {
-		panic("cannot marshal sidecar config: " + err.Error())
-	}
-
-	sidecarConfig = string(sc)
-	configuration := &cfnpatcher.Configuration{
-		Kilt:               fullDefinition,
-		OptIn:              optIn != "",
-		RecipeConfig:       recipeConfig,
-		UseRepositoryHints: disableRepoHints == "",
-		LogGroup:           logGroup,
-		ParameterizeEnvars: strings.ToLower(parameterizeEnvars) == "true",
-		SidecarConfig:      sidecarConfig,
+		l.Error().Err(err).Msg("failed to patch local file")
+		return nil, err
 	}
 
-	return configuration
+	log.Info().Str("template", string(result)).Msg("processing complete")
+	return result, nil
 }
 
 func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
-	configuration := GetConfig()
 	switch os.Getenv("KILT_MODE") {
 	case "local":
-		result, err := PatchLocalFile(configuration, context.Background(), os.Getenv("KILT_SRC_TEMPLATE"))
+		configuration, err := GetConfig(context.Background())
+		if err != nil {
+			log.Fatal().Err(err).Msg("cannot load configuration")
+		}
+		result, err := PatchLocalFile(configuration, context.Background(), os.Getenv("KILT_SRC_TEMPLATE"), os.Getenv("KILT_SRC_PARAMETERS"))
 		if err != nil {
 			panic("cannot patch local file " + os.Getenv("KILT_SRC_TEMPLATE"))
 		}
@@ -181,8 +121,23 @@ func main() {
 		}
 
 	default:
+		// an invalid TTL is reported by GetConfig
+		ttl, _ := reloadTTLFromEnv()
+		configs := newConfigCache(ttl, GetConfig)
+		_, err := configs.Get(context.Background())
+		if err != nil {
+			log.Error().Err(err).Msg("cannot load configuration")
+		}
+
 		lambda.Start(
 			func(ctx context.Context, event MacroInput) (MacroOutput, error) {
+				// a broken configuration fails every transformation with a readable message rather than the
+				// whole function at cold start
+				configuration, err := configs.Get(ctx)
+				if err != nil {
+					log.Error().Err(err).Str("requestId", event.RequestID).Msg("cannot load configuration")
+					return failure(event.RequestID, err), nil
+				}
 				return HandleRequest(configuration, ctx, event)
 			})
 	}
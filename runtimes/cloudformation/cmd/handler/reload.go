@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/sysdiglabs/agent-kilt/runtimes/cloudformation/cfnpatcher"
+)
+
+// reloadTTLFromEnv reads KILT_RELOAD_TTL, 0 keeps the configuration loaded at cold start for the lifetime of the
+// function
+func reloadTTLFromEnv() (time.Duration, error) {
+	ttl := os.Getenv("KILT_RELOAD_TTL")
+	if ttl == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("expected a positive duration")
+	}
+	return d, nil
+}
+
+type loadedConfig struct {
+	configuration *cfnpatcher.Configuration
+	hash          string
+	loadedAt      time.Time
+}
+
+// configCache serves the configuration to invocations and reloads it once ttl expires. Sources revalidate what they
+// return, with ETags or S3 object versions, so unchanged definitions are cheap to reload. A failed reload keeps the
+// last good configuration until the next attempt.
+type configCache struct {
+	ttl  time.Duration
+	load func(ctx context.Context) (*cfnpatcher.Configuration, error)
+	now  func() time.Time
+
+	// mu serializes reloads, readers only go through current
+	mu      sync.Mutex
+	current atomic.Pointer[loadedConfig]
+}
+
+func newConfigCache(ttl time.Duration, load func(ctx context.Context) (*cfnpatcher.Configuration, error)) *configCache {
+	return &configCache{
+		ttl:  ttl,
+		load: load,
+		now:  time.Now,
+	}
+}
+
+func (c *configCache) fresh(loaded *loadedConfig) bool {
+	return loaded != nil && (c.ttl == 0 || c.now().Sub(loaded.loadedAt) < c.ttl)
+}
+
+// Get returns the current configuration, reloading it first when it expired. Until a configuration was loaded
+// successfully, every call tries again.
+func (c *configCache) Get(ctx context.Context) (*cfnpatcher.Configuration, error) {
+	if loaded := c.current.Load(); c.fresh(loaded) {
+		return loaded.configuration, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := c.current.Load()
+	if c.fresh(previous) {
+		return previous.configuration, nil
+	}
+
+	configuration, err := c.load(ctx)
+	if err != nil {
+		if previous == nil {
+			return nil, err
+		}
+		log.Error().Err(err).Str("hash", previous.hash).Msg("could not reload configuration, keeping the last good one")
+		c.current.Store(&loadedConfig{previous.configuration, previous.hash, c.now()})
+		return previous.configuration, nil
+	}
+
+	loaded := &loadedConfig{configuration, definitionHash(configuration), c.now()}
+	c.current.Store(loaded)
+	switch {
+	case previous == nil:
+		log.Info().Str("hash", loaded.hash).Msg("configuration loaded")
+	case previous.hash != loaded.hash:
+		log.Info().Str("hash", loaded.hash).Str("previousHash", previous.hash).Msg("configuration reloaded with new definitions")
+	default:
+		log.Debug().Str("hash", loaded.hash).Msg("configuration reloaded, definitions unchanged")
+	}
+	return configuration, nil
+}
+
+// definitionHash identifies the kilt definitions of a configuration, recipes and recipe config included
+func definitionHash(configuration *cfnpatcher.Configuration) string {
+	h := sha256.New()
+	writeField := func(s string) {
+		_, _ = fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+	writeField(configuration.Kilt)
+	writeField(configuration.RecipeConfig)
+	names := make([]string, 0, len(configuration.Recipes))
+	for name := range configuration.Recipes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeField(name)
+		writeField(configuration.Recipes[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
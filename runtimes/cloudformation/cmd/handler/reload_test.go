@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sysdiglabs/agent-kilt/runtimes/cloudformation/cfnpatcher"
+)
+
+func TestConfigCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	loads := 0
+	var loadErr error
+	definition := "first"
+
+	cache := newConfigCache(time.Minute, func(ctx context.Context) (*cfnpatcher.Configuration, error) {
+		loads++
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		return &cfnpatcher.Configuration{Kilt: definition}, nil
+	})
+	cache.now = func() time.Time { return now }
+
+	configuration, err := cache.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "first", configuration.Kilt)
+
+	definition = "second"
+	configuration, _ = cache.Get(context.Background())
+	assert.Equal(t, "first", configuration.Kilt, "configuration should be cached until the ttl expires")
+	assert.Equal(t, 1, loads)
+
+	now = now.Add(time.Minute)
+	configuration, _ = cache.Get(context.Background())
+	assert.Equal(t, "second", configuration.Kilt)
+	assert.Equal(t, 2, loads)
+
+	now = now.Add(time.Minute)
+	loadErr = errors.New("bucket unavailable")
+	configuration, err = cache.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "second", configuration.Kilt, "last good configuration should be kept")
+	configuration, _ = cache.Get(context.Background())
+	assert.Equal(t, "second", configuration.Kilt)
+	assert.Equal(t, 3, loads, "failed reloads should wait for the ttl too")
+}
+
+func TestConfigCacheInitialFailure(t *testing.T) {
+	loads := 0
+	cache := newConfigCache(0, func(ctx context.Context) (*cfnpatcher.Configuration, error) {
+		loads++
+		if loads == 1 {
+			return nil, errors.New("bucket unavailable")
+		}
+		return &cfnpatcher.Configuration{Kilt: "kilt"}, nil
+	})
+
+	_, err := cache.Get(context.Background())
+	assert.Error(t, err)
+	configuration, err := cache.Get(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "kilt", configuration.Kilt)
+	_, _ = cache.Get(context.Background())
+	assert.Equal(t, 2, loads, "without a ttl the configuration should never be reloaded")
+}
+
+func TestDefinitionHash(t *testing.T) {
+	a := definitionHash(&cfnpatcher.Configuration{Kilt: "kilt", Recipes: map[string]string{"a": "1", "b": "2"}})
+	b := definitionHash(&cfnpatcher.Configuration{Kilt: "kilt", Recipes: map[string]string{"b": "2", "a": "1"}})
+	c := definitionHash(&cfnpatcher.Configuration{Kilt: "kilt", Recipes: map[string]string{"a": "12"}})
+	d := definitionHash(&cfnpatcher.Configuration{Kilt: "kilt", Recipes: map[string]string{"a": "1", "b": "2"}, RecipeConfig: `{"a": 1}`})
+	assert.Equal(t, a, b)
+	assert.NotEqual(t, a, c)
+	assert.NotEqual(t, a, d, "the recipe config is part of the definitions")
+}
@@ -0,0 +1,29 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// AWSEndpointEnv overrides the endpoint of every AWS service used to fetch definitions, e.g. to point at a local
+// emulator in tests
+const AWSEndpointEnv = "KILT_AWS_ENDPOINT_URL"
+
+// newAWSSession creates a session from the environment, honouring AWSEndpointEnv. Settings in cfgs take precedence.
+func newAWSSession(cfgs ...*aws.Config) (*session.Session, error) {
+	cfg := aws.NewConfig()
+	if endpoint := os.Getenv(AWSEndpointEnv); endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+	for _, c := range cfgs {
+		cfg.MergeIn(c)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not create aws session: %w", err)
+	}
+	return sess, nil
+}
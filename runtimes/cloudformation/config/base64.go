@@ -1,20 +1,18 @@
 package config
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 )
 
-func FromBase64(payload string, decompress bool) string {
-	data, err := base64.StdEncoding.DecodeString(payload)
+// Base64Source decodes definitions inlined in the URI, e.g. base64://a2lsdA==
+type Base64Source struct{}
 
+func (Base64Source) Fetch(_ context.Context, payload string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(payload)
 	if err != nil {
-		panic(fmt.Errorf("could not decode base64: %w", err))
+		return nil, fmt.Errorf("could not decode base64: %w", err)
 	}
-
-	if decompress {
-		data = decompressBytes(data)
-	}
-
-	return string(data)
+	return data, nil
 }
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"context"
 	"encoding/base64"
 	"testing"
 
@@ -35,8 +36,25 @@ func TestBase64(t *testing.T) {
 			encoded := base64.StdEncoding.EncodeToString([]byte(tc.plaintext))
 			assert.Equal(t, tc.encoded, encoded, "the encoded string does not match the expected value")
 
-			decoded := FromBase64(encoded, tc.decompress)
-			assert.Equal(t, tc.plaintext, decoded, "decoded and plaintext strings do not match")
+			scheme := "base64://"
+			if tc.decompress {
+				scheme = "base64+gz://"
+			}
+			decoded, err := Fetch(context.Background(), scheme+encoded)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.plaintext, string(decoded), "decoded and plaintext strings do not match")
+
+			decodedString, err := FromBase64(encoded, tc.decompress)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.plaintext, decodedString, "FromBase64 and plaintext strings do not match")
 		})
 	}
 }
+
+func TestBase64Errors(t *testing.T) {
+	_, err := Fetch(context.Background(), "base64://not base64!")
+	assert.Error(t, err)
+
+	_, err = Fetch(context.Background(), "base64+gz://"+base64.StdEncoding.EncodeToString([]byte("not gzip")))
+	assert.Error(t, err)
+}
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownType is returned when loading a definition of a type that is not one of the constants in types.go
+var ErrUnknownType = errors.New("unrecognized definition type")
+
+// VariableError is an invalid value of a single environment variable
+type VariableError struct {
+	Variable string
+	Err      error
+}
+
+func (e *VariableError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Variable, e.Err)
+}
+
+func (e *VariableError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError collects every invalid environment variable so that they can be reported at once
+type ValidationError struct {
+	Errors []*VariableError
+}
+
+// Add records err against variable, nil errors are ignored
+func (e *ValidationError) Add(variable string, err error) {
+	if err != nil {
+		e.Errors = append(e.Errors, &VariableError{variable, err})
+	}
+}
+
+// Err returns e when any error was recorded and nil otherwise
+func (e *ValidationError) Err() error {
+	if len(e.Errors) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e *ValidationError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		problems = append(problems, err.Error())
+	}
+	return "invalid configuration: " + strings.Join(problems, "; ")
+}
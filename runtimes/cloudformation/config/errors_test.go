@@ -0,0 +1,21 @@
+package config
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidationError(t *testing.T) {
+	problems := &ValidationError{}
+	problems.Add("KILT_SIDECAR_CPU", nil)
+	assert.NoError(t, problems.Err())
+
+	problems.Add("KILT_SIDECAR_CPU", errors.New("expected an integer"))
+	problems.Add("KILT_DEFINITION_TYPE", ErrUnknownType)
+	err := problems.Err()
+	assert.Error(t, err)
+	assert.ErrorIs(t, err, ErrUnknownType)
+	assert.Equal(t, "invalid configuration: KILT_SIDECAR_CPU: expected an integer; KILT_DEFINITION_TYPE: unrecognized definition type", err.Error())
+}
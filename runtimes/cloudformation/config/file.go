@@ -0,0 +1,13 @@
+package config
+
+import (
+	"context"
+	"os"
+)
+
+// FileSource reads definitions from the local filesystem, e.g. file:///opt/kilt/definition.cfg
+type FileSource struct{}
+
+func (FileSource) Fetch(_ context.Context, path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
@@ -1,22 +1,232 @@
 package config
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	neturl "net/url"
+	"strings"
+	"sync"
+	"time"
 )
 
-func FromWeb(url string) string {
-	resp, err := http.Get(url)
+const (
+	DefaultWebTimeout     = 10 * time.Second
+	DefaultWebRetries     = 3
+	DefaultWebBackoff     = 500 * time.Millisecond
+	DefaultWebMaxBodySize = 10 << 20
+)
+
+const (
+	AuthBearer = "bearer"
+	AuthBasic  = "basic"
+)
+
+// WebAuth sets the Authorization header of the definition requests under URLPrefix. Credentials are never sent to
+// other URLs, e.g. recipes or signatures hosted elsewhere, nor over plain http.
+type WebAuth struct {
+	// URLPrefix is the https URL the credentials are scoped to, e.g. https://definitions.example.com/kilt/
+	URLPrefix string
+	// Type is AuthBearer or AuthBasic
+	Type string
+	// Secret is the bearer token, or user:password for basic auth
+	Secret string
+	// SecretURI is fetched through the DefaultRegistry for the secret when Secret is empty,
+	// e.g. secretsmanager://kilt-definition-token
+	SecretURI string
+}
+
+// WebSource downloads definitions over HTTP, Scheme is either http or https. Zero values of the other fields
+// select the defaults above, a negative Retries disables retries. Requests are retried with exponential backoff
+// on network errors and 5xx responses, any other non 2xx response is an error.
+type WebSource struct {
+	Scheme string
+	// Client defaults to a client with Timeout
+	Client      *http.Client
+	Timeout     time.Duration
+	Retries     int
+	Backoff     time.Duration
+	MaxBodySize int64
+	Auth        *WebAuth
+
+	mu sync.Mutex
+	// cache holds the last response of every URL with an ETag, to revalidate it with If-None-Match
+	cache map[string]cachedResponse
+}
+
+type cachedResponse struct {
+	etag string
+	body []byte
+}
+
+// retryableError marks failures worth another attempt
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+func (s *WebSource) Fetch(ctx context.Context, location string) ([]byte, error) {
+	url := s.Scheme + "://" + location
+	var authorization string
+	if s.Auth != nil && s.Auth.appliesTo(url) {
+		var err error
+		authorization, err = s.authorization(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	retries := s.Retries
+	if retries == 0 {
+		retries = DefaultWebRetries
+	} else if retries < 0 {
+		retries = 0
+	}
+	backoff := s.Backoff
+	if backoff == 0 {
+		backoff = DefaultWebBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		data, err := s.fetchOnce(ctx, url, authorization)
+		var retryable *retryableError
+		if err == nil || !errors.As(err, &retryable) || attempt >= retries {
+			return data, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w, last error: %s", ctx.Err(), err)
+		case <-time.After(backoff << attempt):
+		}
+	}
+}
+
+func (s *WebSource) fetchOnce(ctx context.Context, url string, authorization string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create http request: %w", err)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	cached, hasCached := s.cached(url)
+	if hasCached {
+		req.Header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, err := s.client().Do(req)
 	if err != nil {
-		panic(fmt.Errorf("could not perform http request: %w", err))
+		return nil, &retryableError{fmt.Errorf("could not perform http request: %w", err)}
 	}
-	data, err := ioutil.ReadAll(resp.Body)
 	defer resp.Body.Close()
 
+	switch {
+	case resp.StatusCode == http.StatusNotModified && hasCached:
+		return cached.body, nil
+	case resp.StatusCode >= 500:
+		return nil, &retryableError{fmt.Errorf("unexpected http status %s", resp.Status)}
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return nil, fmt.Errorf("unexpected http status %s", resp.Status)
+	}
+
+	maxBodySize := s.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultWebMaxBodySize
+	}
+	data, err := readLimited(resp.Body, maxBodySize)
 	if err != nil {
-		panic(fmt.Errorf("could not read http response: %w", err))
+		return nil, fmt.Errorf("could not read http response: %w", err)
 	}
 
-	return string(data)
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		s.store(url, cachedResponse{etag, data})
+	}
+	return data, nil
+}
+
+func (s *WebSource) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = DefaultWebTimeout
+	}
+	return &http.Client{Timeout: timeout}
+}
+
+// ValidateURLPrefix checks that prefix is an https URL with a host, credentials could leak otherwise
+func ValidateURLPrefix(prefix string) error {
+	u, err := neturl.Parse(prefix)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("expected an https URL, e.g. https://definitions.example.com/kilt/")
+	}
+	return nil
+}
+
+// appliesTo tells whether url is an https URL on the host of URLPrefix, under its path
+func (a *WebAuth) appliesTo(url string) bool {
+	if ValidateURLPrefix(a.URLPrefix) != nil {
+		return false
+	}
+	prefix, _ := neturl.Parse(a.URLPrefix)
+	u, err := neturl.Parse(url)
+	if err != nil || u.Scheme != "https" || !strings.EqualFold(u.Host, prefix.Host) {
+		return false
+	}
+	return strings.HasPrefix(u.Path, prefix.Path)
+}
+
+func (s *WebSource) authorization(ctx context.Context) (string, error) {
+	secret := s.Auth.Secret
+	if secret == "" && s.Auth.SecretURI != "" {
+		data, err := Fetch(ctx, s.Auth.SecretURI)
+		if err != nil {
+			return "", fmt.Errorf("could not retrieve http credentials: %w", err)
+		}
+		secret = strings.TrimSpace(string(data))
+	}
+	if secret == "" {
+		return "", fmt.Errorf("missing http credentials")
+	}
+
+	switch strings.ToLower(s.Auth.Type) {
+	case AuthBearer:
+		return "Bearer " + secret, nil
+	case AuthBasic:
+		if !strings.Contains(secret, ":") {
+			return "", fmt.Errorf("basic auth credentials must be user:password")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(secret)), nil
+	default:
+		return "", fmt.Errorf("unknown http auth type %q, expected %s or %s", s.Auth.Type, AuthBearer, AuthBasic)
+	}
+}
+
+func (s *WebSource) cached(url string) (cachedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.cache[url]
+	return c, ok
+}
+
+func (s *WebSource) store(url string, response cachedResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cache == nil {
+		s.cache = make(map[string]cachedResponse)
+	}
+	s.cache[url] = response
 }
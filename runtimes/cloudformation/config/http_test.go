@@ -0,0 +1,138 @@
+package config
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebSourceRetries(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("kilt"))
+	}))
+	defer server.Close()
+
+	location := strings.TrimPrefix(server.URL, "http://")
+	s := &WebSource{Scheme: "http", Backoff: time.Millisecond}
+	data, err := s.Fetch(context.Background(), location)
+	assert.NoError(t, err)
+	assert.Equal(t, "kilt", string(data))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	atomic.StoreInt32(&requests, 0)
+	s = &WebSource{Scheme: "http", Backoff: time.Millisecond, Retries: -1}
+	_, err = s.Fetch(context.Background(), location)
+	assert.ErrorContains(t, err, "503")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestWebSourceErrors(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/large":
+			_, _ = w.Write([]byte(strings.Repeat("k", 100)))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	location := strings.TrimPrefix(server.URL, "http://")
+
+	s := &WebSource{Scheme: "http", Backoff: time.Millisecond}
+	_, err := s.Fetch(context.Background(), location+"/missing")
+	assert.ErrorContains(t, err, "404")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests), "client errors should not be retried")
+
+	s = &WebSource{Scheme: "http", MaxBodySize: 10}
+	_, err = s.Fetch(context.Background(), location+"/large")
+	assert.ErrorContains(t, err, "exceeds 10 bytes")
+
+	s = &WebSource{Scheme: "http", Timeout: 10 * time.Millisecond, Retries: -1}
+	_, err = s.Fetch(context.Background(), location+"/slow")
+	assert.Error(t, err)
+}
+
+func TestWebSourceETag(t *testing.T) {
+	var served int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&served, 1)
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("kilt"))
+	}))
+	defer server.Close()
+
+	s := &WebSource{Scheme: "http"}
+	for i := 0; i < 2; i++ {
+		data, err := s.Fetch(context.Background(), strings.TrimPrefix(server.URL, "http://"))
+		assert.NoError(t, err)
+		assert.Equal(t, "kilt", string(data))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&served))
+}
+
+func TestWebSourceAuth(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+	location := strings.TrimPrefix(server.URL, "https://")
+	prefix := server.URL + "/"
+
+	tests := []struct {
+		auth     WebAuth
+		expected string
+	}{
+		{WebAuth{URLPrefix: prefix, Type: AuthBearer, Secret: "token"}, "Bearer token"},
+		{WebAuth{URLPrefix: prefix, Type: "Basic", Secret: "user:password"}, "Basic dXNlcjpwYXNzd29yZA=="},
+		{WebAuth{URLPrefix: prefix, Type: AuthBearer, SecretURI: "base64://c2VjcmV0LXRva2VuCg=="}, "Bearer secret-token"},
+		// credentials are scoped to their URL prefix and never sent over plain http
+		{WebAuth{URLPrefix: server.URL + "/private/", Type: AuthBearer, Secret: "token"}, ""},
+		{WebAuth{URLPrefix: "https://other.example.com/", Type: AuthBearer, Secret: "token"}, ""},
+		{WebAuth{URLPrefix: "http://" + location + "/", Type: AuthBearer, Secret: "token"}, ""},
+		{WebAuth{Type: AuthBearer, Secret: "token"}, ""},
+	}
+	for _, tc := range tests {
+		auth := tc.auth
+		s := &WebSource{Scheme: "https", Client: server.Client(), Auth: &auth}
+		data, err := s.Fetch(context.Background(), location+"/kilt.cfg")
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, string(data), tc.auth.URLPrefix)
+	}
+
+	plain := httptest.NewServer(server.Config.Handler)
+	defer plain.Close()
+	auth := WebAuth{URLPrefix: "https://" + strings.TrimPrefix(plain.URL, "http://"), Type: AuthBearer, Secret: "token"}
+	data, err := (&WebSource{Scheme: "http", Auth: &auth}).Fetch(context.Background(), strings.TrimPrefix(plain.URL, "http://"))
+	assert.NoError(t, err)
+	assert.Equal(t, "", string(data), "credentials must not be sent over plain http")
+
+	for _, auth := range []WebAuth{
+		{URLPrefix: prefix, Type: AuthBearer},
+		{URLPrefix: prefix, Type: AuthBasic, Secret: "password"},
+		{URLPrefix: prefix, Type: "digest", Secret: "token"},
+	} {
+		auth := auth
+		s := &WebSource{Scheme: "https", Client: server.Client(), Auth: &auth}
+		_, err := s.Fetch(context.Background(), location+"/kilt.cfg")
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// SignatureSuffix is appended to the path of a definition to find its detached signature by default
+const SignatureSuffix = ".sig"
+
+// ErrIntegrity is wrapped by every failed integrity check
+var ErrIntegrity = errors.New("integrity check failed")
+
+// Integrity pins downloaded definitions to a sha256 digest and/or requires a detached signature made with the private
+// half of PublicKey. Both are checked against the bytes as downloaded, before any decompression.
+type Integrity struct {
+	// SHA256 is the expected hex encoded digest, empty to skip the check
+	SHA256 string
+	// PublicKey is an ed25519 or ECDSA key, nil to skip the check. ECDSA signatures are made over the sha256
+	// digest of the definition, as `cosign sign-blob` does.
+	PublicKey crypto.PublicKey
+	// SignatureURI is where the base64 or raw signature is fetched from, by default the definition path followed by
+	// SignatureSuffix, see defaultSignatureURI
+	SignatureURI string
+}
+
+// NewIntegrity validates the settings of an integrity check, it returns nil when there is nothing to check
+func NewIntegrity(sha256Digest string, publicKeyPEM string, signatureURI string) (*Integrity, error) {
+	if sha256Digest == "" && publicKeyPEM == "" {
+		if signatureURI != "" {
+			return nil, fmt.Errorf("a signature location requires a public key")
+		}
+		return nil, nil
+	}
+	integrity := &Integrity{
+		SHA256:       strings.ToLower(strings.TrimSpace(sha256Digest)),
+		SignatureURI: signatureURI,
+	}
+	if integrity.SHA256 != "" {
+		digest, err := hex.DecodeString(integrity.SHA256)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha256 digest %q: expected %d hex encoded bytes", sha256Digest, sha256.Size)
+		}
+	}
+	if publicKeyPEM != "" {
+		key, err := ParsePublicKey([]byte(publicKeyPEM))
+		if err != nil {
+			return nil, err
+		}
+		integrity.PublicKey = key
+	}
+	return integrity, nil
+}
+
+// ParsePublicKey parses a PEM encoded PKIX ed25519 or ECDSA public key, as written by `cosign generate-key-pair`
+// or `openssl pkey -pubout`
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("invalid public key: no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T, expected ed25519 or ECDSA", key)
+	}
+}
+
+// defaultSignatureURI appends SignatureSuffix to the path of location, before its query string. The query is kept,
+// except for the S3 versionId, which pins the version of the definition and not of its signature.
+func defaultSignatureURI(scheme, location string) string {
+	path, query, hasQuery := strings.Cut(location, "?")
+	if hasQuery && scheme == S3 {
+		values, err := url.ParseQuery(query)
+		if err == nil {
+			values.Del("versionId")
+			query = values.Encode()
+		}
+	}
+	uri := scheme + "://" + path + SignatureSuffix
+	if query != "" {
+		uri += "?" + query
+	}
+	return uri
+}
+
+func (i *Integrity) verify(ctx context.Context, r *Registry, scheme, location string, data []byte) error {
+	digest := sha256.Sum256(data)
+	if i.SHA256 != "" {
+		expected, _ := hex.DecodeString(i.SHA256)
+		if subtle.ConstantTimeCompare(expected, digest[:]) != 1 {
+			return fmt.Errorf("%w: sha256 digest is %x, expected %s", ErrIntegrity, digest, i.SHA256)
+		}
+	}
+	if i.PublicKey == nil {
+		return nil
+	}
+
+	signatureURI := i.SignatureURI
+	if signatureURI == "" {
+		if scheme == "base64" {
+			return fmt.Errorf("%w: inline definitions need an explicit signature location", ErrIntegrity)
+		}
+		signatureURI = defaultSignatureURI(scheme, location)
+	}
+	signature, err := r.Fetch(ctx, signatureURI)
+	if err != nil {
+		return fmt.Errorf("%w: could not fetch signature: %s", ErrIntegrity, err)
+	}
+	signature = decodeSignature(signature)
+
+	switch key := i.PublicKey.(type) {
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, data, signature) {
+			return fmt.Errorf("%w: invalid ed25519 signature", ErrIntegrity)
+		}
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(key, digest[:], signature) {
+			return fmt.Errorf("%w: invalid ECDSA signature", ErrIntegrity)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported public key type %T", ErrIntegrity, i.PublicKey)
+	}
+	return nil
+}
+
+// decodeSignature accepts base64 encoded signatures, as written by cosign, as well as raw ones
+func decodeSignature(signature []byte) []byte {
+	decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+	if err != nil {
+		return signature
+	}
+	return decoded
+}
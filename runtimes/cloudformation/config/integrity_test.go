@@ -0,0 +1,153 @@
+package config
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func publicKeyPEM(t *testing.T, key interface{}) string {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	assert.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestIntegrity(t *testing.T) {
+	definition := []byte("build { entry_point: [\"/kilt/run\"] }")
+	digest := sha256.Sum256(definition)
+
+	edPublic, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	ecPrivate, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ecSignature, err := ecdsa.SignASN1(rand.Reader, ecPrivate, digest[:])
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, data, 0644))
+		return "file://" + path
+	}
+	uri := write("kilt.cfg", definition)
+	write("kilt.cfg.sig", []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(edPrivate, definition))))
+	rawSignature := write("raw.sig", ed25519.Sign(edPrivate, definition))
+	ecSignatureURI := write("cosign.sig", []byte(base64.StdEncoding.EncodeToString(ecSignature)))
+	badSignature := write("bad.sig", []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(edPrivate, []byte("other")))))
+
+	tests := []struct {
+		name      string
+		sha256    string
+		publicKey string
+		signature string
+		valid     bool
+	}{
+		{"digest", hex.EncodeToString(digest[:]), "", "", true},
+		{"wrong digest", hex.EncodeToString(make([]byte, sha256.Size)), "", "", false},
+		{"ed25519 default signature", "", publicKeyPEM(t, edPublic), "", true},
+		{"ed25519 raw signature", "", publicKeyPEM(t, edPublic), rawSignature, true},
+		{"ed25519 bad signature", "", publicKeyPEM(t, edPublic), badSignature, false},
+		{"ed25519 missing signature", "", publicKeyPEM(t, edPublic), uri + ".missing", false},
+		{"ecdsa signature", "", publicKeyPEM(t, &ecPrivate.PublicKey), ecSignatureURI, true},
+		{"ecdsa signature with ed25519 key", "", publicKeyPEM(t, edPublic), ecSignatureURI, false},
+		{"digest and signature", hex.EncodeToString(digest[:]), publicKeyPEM(t, edPublic), "", true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			integrity, err := NewIntegrity(tc.sha256, tc.publicKey, tc.signature)
+			assert.NoError(t, err)
+			data, err := NewRegistry().FetchVerified(context.Background(), uri, integrity)
+			if !tc.valid {
+				assert.ErrorIs(t, err, ErrIntegrity)
+				assert.Nil(t, data)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, definition, data)
+		})
+	}
+}
+
+func TestNewIntegrity(t *testing.T) {
+	integrity, err := NewIntegrity("", "", "")
+	assert.NoError(t, err)
+	assert.Nil(t, integrity)
+
+	for _, args := range [][3]string{
+		{"abc", "", ""},
+		{"", "not a key", ""},
+		{"", "", "file:///tmp/kilt.cfg.sig"},
+	} {
+		_, err := NewIntegrity(args[0], args[1], args[2])
+		assert.Error(t, err, args)
+	}
+}
+
+func TestDefaultSignatureURI(t *testing.T) {
+	tests := []struct {
+		scheme   string
+		location string
+		expected string
+	}{
+		{"file", "/opt/kilt.cfg", "file:///opt/kilt.cfg.sig"},
+		{"s3", "bucket/kilt.cfg?versionId=v1&region=eu-west-1", "s3://bucket/kilt.cfg.sig?region=eu-west-1"},
+		{"s3", "bucket/kilt.cfg?versionId=v1", "s3://bucket/kilt.cfg.sig"},
+		{"https", "example.com/kilt.cfg?ref=main", "https://example.com/kilt.cfg.sig?ref=main"},
+	}
+	for _, tc := range tests {
+		assert.Equal(t, tc.expected, defaultSignatureURI(tc.scheme, tc.location), tc.location)
+	}
+}
+
+func TestIntegrityS3Query(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	definition := []byte("build { entry_point: [\"/kilt/run\"] }")
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(private, definition))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/bucket/kilt.cfg" && r.URL.Query().Get("versionId") == "v1":
+			_, _ = w.Write(definition)
+		case r.URL.Path == "/bucket/kilt.cfg.sig" && r.URL.Query().Get("versionId") == "":
+			_, _ = w.Write([]byte(signature))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	registry := NewRegistry()
+	registry.Register("s3", &S3Source{Region: "us-east-1", Endpoint: server.URL, ForcePathStyle: true})
+	integrity, err := NewIntegrity("", publicKeyPEM(t, public), "")
+	assert.NoError(t, err)
+	data, err := registry.FetchVerified(context.Background(), "s3://bucket/kilt.cfg?versionId=v1&region=us-east-1", integrity)
+	assert.NoError(t, err)
+	assert.Equal(t, definition, data)
+}
+
+func TestWebSourceStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	_, err := NewRegistry().Fetch(context.Background(), server.URL+"/kilt.cfg")
+	assert.ErrorContains(t, err, "404")
+}
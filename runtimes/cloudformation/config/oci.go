@@ -0,0 +1,163 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+const (
+	// RecipeMediaType is the media type of the layer holding the kilt definition in an OCI artifact
+	RecipeMediaType = "application/vnd.sysdig.kilt.recipe.v1"
+	// RecipeConfigMediaType is the media type of the optional layer holding the recipe config, a JSON document
+	RecipeConfigMediaType = "application/vnd.sysdig.kilt.recipe-config.v1+json"
+	// RecipeConfigFragment appended to an oci:// location selects the recipe config instead of the definition
+	RecipeConfigFragment = "#config"
+)
+
+// ErrNoRecipeConfig is returned when an OCI artifact has no recipe config layer
+var ErrNoRecipeConfig = errors.New("no recipe config in artifact")
+
+// OCISource pulls definitions stored as layers of OCI artifacts, by tag or digest, e.g.
+// oci://registry.example.com/kilt/recipe:1.0 or oci://registry.example.com/kilt/recipe@sha256:...
+// The definition is the layer with RecipeMediaType, or the only layer of the artifact.
+type OCISource struct {
+	// Keychain authenticates against registries, authn.DefaultKeychain when nil
+	Keychain authn.Keychain
+	// Options are handed to crane after the keychain and the context
+	Options []crane.Option
+	// MaxSize is the largest layer accepted, DefaultS3MaxSize when 0
+	MaxSize int64
+}
+
+// Artifact is what an OCI artifact holds, read from a single manifest so that every part comes from the same artifact
+// even when its tag moves
+type Artifact struct {
+	// Digest of the manifest, e.g. sha256:...
+	Digest string
+	// Manifest is the manifest as served by the registry, it pins the digest of every layer
+	Manifest []byte
+	// Definition is the layer with RecipeMediaType, or the only layer of the artifact
+	Definition []byte
+	// RecipeConfig is the layer with RecipeConfigMediaType, nil when there is none
+	RecipeConfig []byte
+}
+
+func (s *OCISource) Fetch(ctx context.Context, location string) ([]byte, error) {
+	data, _, err := s.FetchAttested(ctx, location)
+	return data, err
+}
+
+// FetchAttested returns the layer at location along with the manifest of the artifact, which integrity checks apply to
+func (s *OCISource) FetchAttested(ctx context.Context, location string) ([]byte, []byte, error) {
+	reference, fragment, hasFragment := strings.Cut(location, "#")
+	if hasFragment && "#"+fragment != RecipeConfigFragment {
+		return nil, nil, fmt.Errorf("unknown fragment #%s, expected %s", fragment, RecipeConfigFragment)
+	}
+	artifact, err := s.FetchArtifact(ctx, reference)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !hasFragment {
+		return artifact.Definition, artifact.Manifest, nil
+	}
+	if artifact.RecipeConfig == nil {
+		return nil, nil, fmt.Errorf("%s: %w", reference, ErrNoRecipeConfig)
+	}
+	return artifact.RecipeConfig, artifact.Manifest, nil
+}
+
+// FetchArtifact pulls the manifest of the artifact at reference once and reads the definition and the recipe config
+// from it. The registry client checks every layer against the digest in the manifest.
+func (s *OCISource) FetchArtifact(ctx context.Context, reference string) (*Artifact, error) {
+	keychain := s.Keychain
+	if keychain == nil {
+		keychain = authn.DefaultKeychain
+	}
+	options := append([]crane.Option{crane.WithContext(ctx), crane.WithAuthFromKeychain(keychain)}, s.Options...)
+	img, err := crane.Pull(reference, options...)
+	if err != nil {
+		return nil, fmt.Errorf("could not pull %s: %w", reference, err)
+	}
+	raw, err := img.RawManifest()
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest of %s: %w", reference, err)
+	}
+	manifest, err := v1.ParseManifest(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse manifest of %s: %w", reference, err)
+	}
+	digest, err := img.Digest()
+	if err != nil {
+		return nil, fmt.Errorf("could not compute digest of %s: %w", reference, err)
+	}
+	artifact := &Artifact{Digest: digest.String(), Manifest: raw}
+
+	layer, err := findLayer(manifest, RecipeMediaType)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", reference, err)
+	}
+	artifact.Definition, err = s.readLayer(img, reference, layer)
+	if err != nil {
+		return nil, err
+	}
+	layer, err = findLayer(manifest, RecipeConfigMediaType)
+	if errors.Is(err, ErrNoRecipeConfig) {
+		return artifact, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", reference, err)
+	}
+	artifact.RecipeConfig, err = s.readLayer(img, reference, layer)
+	if err != nil {
+		return nil, err
+	}
+	return artifact, nil
+}
+
+func (s *OCISource) readLayer(img v1.Image, reference string, layer *v1.Descriptor) ([]byte, error) {
+	maxSize := s.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultS3MaxSize
+	}
+	if layer.Size > maxSize {
+		return nil, fmt.Errorf("layer %s of %s is %d bytes, more than the %d allowed", layer.Digest, reference, layer.Size, maxSize)
+	}
+
+	blob, err := img.LayerByDigest(layer.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("could not find layer %s of %s: %w", layer.Digest, reference, err)
+	}
+	// artifact layers hold the file as is, Compressed returns the blob without any processing
+	rc, err := blob.Compressed()
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch layer %s of %s: %w", layer.Digest, reference, err)
+	}
+	defer rc.Close()
+	data, err := readLimited(rc, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not read layer %s of %s: %w", layer.Digest, reference, err)
+	}
+	return data, nil
+}
+
+func findLayer(manifest *v1.Manifest, mediaType string) (*v1.Descriptor, error) {
+	for i := range manifest.Layers {
+		if string(manifest.Layers[i].MediaType) == mediaType {
+			return &manifest.Layers[i], nil
+		}
+	}
+	if mediaType == RecipeConfigMediaType {
+		return nil, ErrNoRecipeConfig
+	}
+	if len(manifest.Layers) == 1 {
+		return &manifest.Layers[0], nil
+	}
+	return nil, fmt.Errorf("no layer with media type %s among %d layers", mediaType, len(manifest.Layers))
+}
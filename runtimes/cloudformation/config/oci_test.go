@@ -0,0 +1,158 @@
+package config
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func pushArtifactWith(t *testing.T, ref string, options ...crane.Option) {
+	t.Helper()
+	pushArtifactOptions(t, ref, map[types.MediaType]string{RecipeMediaType: "build {}"}, options...)
+}
+
+func pushArtifact(t *testing.T, ref string, layers map[types.MediaType]string) string {
+	t.Helper()
+	return pushArtifactOptions(t, ref, layers)
+}
+
+func pushArtifactOptions(t *testing.T, ref string, layers map[types.MediaType]string, options ...crane.Option) string {
+	t.Helper()
+	img := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	for _, mediaType := range []types.MediaType{RecipeMediaType, RecipeConfigMediaType, "text/plain"} {
+		if data, ok := layers[mediaType]; ok {
+			var err error
+			img, err = mutate.Append(img, mutate.Addendum{Layer: static.NewLayer([]byte(data), mediaType)})
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, crane.Push(img, ref, options...))
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	return digest.String()
+}
+
+func TestOCISource(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	digest := pushArtifact(t, host+"/kilt/recipe:1.0", map[types.MediaType]string{
+		RecipeMediaType:       "build {}",
+		RecipeConfigMediaType: `{"collector":"collector.example.com"}`,
+		"text/plain":          "README",
+	})
+	pushArtifact(t, host+"/kilt/bare:latest", map[types.MediaType]string{"text/plain": "build { bare: true }"})
+	pushArtifact(t, host+"/kilt/noise:latest", map[types.MediaType]string{
+		RecipeConfigMediaType: "{}",
+		"text/plain":          "README",
+	})
+
+	source := &OCISource{Keychain: authn.NewMultiKeychain()}
+	ctx := context.Background()
+
+	data, err := source.Fetch(ctx, host+"/kilt/recipe:1.0")
+	require.NoError(t, err)
+	assert.Equal(t, "build {}", string(data))
+
+	data, err = source.Fetch(ctx, host+"/kilt/recipe@"+digest)
+	require.NoError(t, err)
+	assert.Equal(t, "build {}", string(data))
+
+	data, err = source.Fetch(ctx, host+"/kilt/recipe:1.0"+RecipeConfigFragment)
+	require.NoError(t, err)
+	assert.Equal(t, `{"collector":"collector.example.com"}`, string(data))
+
+	// a single layer is the definition whatever its media type
+	data, err = source.Fetch(ctx, host+"/kilt/bare:latest")
+	require.NoError(t, err)
+	assert.Equal(t, "build { bare: true }", string(data))
+
+	_, err = source.Fetch(ctx, host+"/kilt/bare:latest"+RecipeConfigFragment)
+	assert.True(t, errors.Is(err, ErrNoRecipeConfig))
+
+	_, err = source.Fetch(ctx, host+"/kilt/noise:latest")
+	assert.ErrorContains(t, err, "no layer with media type")
+
+	_, err = source.Fetch(ctx, host+"/kilt/recipe:1.0#other")
+	assert.ErrorContains(t, err, "unknown fragment")
+
+	_, err = source.Fetch(ctx, host+"/kilt/missing:1.0")
+	assert.ErrorContains(t, err, "could not pull")
+
+	small := &OCISource{Keychain: authn.NewMultiKeychain(), MaxSize: 4}
+	_, err = small.Fetch(ctx, host+"/kilt/recipe:1.0")
+	assert.ErrorContains(t, err, "more than the 4 allowed")
+
+	r := NewRegistry()
+	r.Register("oci", source)
+	uri, err := DefinitionURI(OCI, host+"/kilt/recipe:1.0")
+	require.NoError(t, err)
+	data, err = r.Fetch(ctx, uri)
+	require.NoError(t, err)
+	assert.Equal(t, "build {}", string(data))
+}
+
+func TestLoadArtifact(t *testing.T) {
+	server := httptest.NewServer(registry.New())
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	digest := pushArtifact(t, host+"/kilt/recipe:1.0", map[types.MediaType]string{
+		RecipeMediaType:       "build {}",
+		RecipeConfigMediaType: `{"collector":"collector.example.com"}`,
+	})
+	pushArtifact(t, host+"/kilt/bare:latest", map[types.MediaType]string{RecipeMediaType: "build { bare: true }"})
+	manifest, err := crane.Manifest(host + "/kilt/recipe:1.0")
+	require.NoError(t, err)
+
+	r := NewRegistry()
+	r.Register("oci", &OCISource{Keychain: authn.NewMultiKeychain()})
+	ctx := context.Background()
+
+	definition, recipeConfig, err := r.LoadArtifact(ctx, "oci://"+host+"/kilt/recipe:1.0", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "build {}", definition)
+	assert.Equal(t, `{"collector":"collector.example.com"}`, recipeConfig)
+
+	definition, recipeConfig, err = r.LoadArtifact(ctx, "oci://"+host+"/kilt/bare:latest", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "build { bare: true }", definition)
+	assert.Equal(t, "", recipeConfig)
+
+	// integrity checks apply to the manifest, which pins the definition and the recipe config
+	integrity := &Integrity{SHA256: strings.TrimPrefix(digest, "sha256:")}
+	_, _, err = r.LoadArtifact(ctx, "oci://"+host+"/kilt/recipe:1.0", integrity)
+	assert.NoError(t, err)
+	_, err = r.FetchVerified(ctx, "oci://"+host+"/kilt/recipe:1.0", integrity)
+	assert.NoError(t, err)
+	_, _, err = r.LoadArtifact(ctx, "oci://"+host+"/kilt/bare:latest", integrity)
+	assert.True(t, errors.Is(err, ErrIntegrity))
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	for signed, valid := range map[string]bool{string(manifest): true, "build {}": false} {
+		signature := base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(signed)))
+		integrity := &Integrity{PublicKey: public, SignatureURI: "base64://" + base64.StdEncoding.EncodeToString([]byte(signature))}
+		_, _, err = r.LoadArtifact(ctx, "oci://"+host+"/kilt/recipe:1.0", integrity)
+		assert.Equal(t, valid, err == nil, err)
+	}
+
+	_, _, err = r.LoadArtifact(ctx, "s3://bucket/kilt.cfg", nil)
+	assert.ErrorContains(t, err, "not an OCI artifact")
+}
@@ -0,0 +1,343 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	dockerconfig "github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const (
+	// RegistryAuthECR requests a token from ECR for the account and region in the registry host
+	RegistryAuthECR = "ecr"
+	// RegistryAuthSecretsManager reads a username and password from a Secrets Manager secret, in the format ECS
+	// expects for repository credentials: {"username": "...", "password": "..."}
+	RegistryAuthSecretsManager = "secretsmanager"
+	// RegistryAuthDockerConfig looks the registry up in a docker config.json, credential helpers included
+	RegistryAuthDockerConfig = "dockerconfig"
+	// RegistryAuthAnonymous sends no credentials
+	RegistryAuthAnonymous = "anonymous"
+)
+
+var RegistryAuthTypes = []string{RegistryAuthECR, RegistryAuthSecretsManager, RegistryAuthDockerConfig, RegistryAuthAnonymous}
+
+const (
+	// DefaultRegistryAuthTimeout bounds the time spent retrieving the credentials of a registry
+	DefaultRegistryAuthTimeout = 10 * time.Second
+	// DefaultRegistryAuthTTL is how long credentials read from Secrets Manager or docker configs are kept
+	DefaultRegistryAuthTTL = 15 * time.Minute
+	// ecrTokenMargin renews ECR tokens a little before they expire
+	ecrTokenMargin = 5 * time.Minute
+)
+
+// dockerHub is the usual name of name.DefaultRegistry
+const dockerHub = "docker.io"
+
+var ecrHost = regexp.MustCompile(`^(\d{12})\.dkr\.ecr(-fips)?\.([a-z0-9-]+)\.amazonaws\.com(\.cn)?$`)
+
+// RegistryAuthRule says how to authenticate against the registries whose host matches Registry, a glob such as
+// *.dkr.ecr.*.amazonaws.com
+type RegistryAuthRule struct {
+	Registry string `json:"registry"`
+	Type     string `json:"type"`
+	// Secret is the name or ARN of the secret of RegistryAuthSecretsManager rules
+	Secret string `json:"secret,omitempty"`
+	// Path is the docker config.json of RegistryAuthDockerConfig rules
+	Path string `json:"path,omitempty"`
+}
+
+func (r *RegistryAuthRule) validate() error {
+	if r.Registry == "" {
+		return fmt.Errorf("missing registry")
+	}
+	if _, err := path.Match(r.Registry, ""); err != nil {
+		return fmt.Errorf("invalid registry pattern %q: %w", r.Registry, err)
+	}
+	switch r.Type {
+	case RegistryAuthECR, RegistryAuthAnonymous:
+	case RegistryAuthSecretsManager:
+		if r.Secret == "" {
+			return fmt.Errorf("registry %s: missing secret", r.Registry)
+		}
+	case RegistryAuthDockerConfig:
+		if r.Path == "" {
+			return fmt.Errorf("registry %s: missing path", r.Registry)
+		}
+	default:
+		return fmt.Errorf("registry %s: unknown type %q, expected one of %s", r.Registry, r.Type, strings.Join(RegistryAuthTypes, ", "))
+	}
+	return nil
+}
+
+// ParseRegistryAuthRules reads a JSON list of rules, e.g.
+// [{"registry": "*.dkr.ecr.*.amazonaws.com", "type": "ecr"}, {"registry": "docker.io", "type": "secretsmanager", "secret": "dockerhub"}]
+// RegistryAuthSecretsManager rules without a secret use defaultSecret. docker.io and index.docker.io both match Docker
+// Hub.
+func ParseRegistryAuthRules(rules string, defaultSecret string) ([]RegistryAuthRule, error) {
+	if rules == "" {
+		return nil, nil
+	}
+	var parsed []RegistryAuthRule
+	err := json.Unmarshal([]byte(rules), &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("expected a JSON list of rules: %w", err)
+	}
+	for i := range parsed {
+		if parsed[i].Type == RegistryAuthSecretsManager && parsed[i].Secret == "" {
+			parsed[i].Secret = defaultSecret
+		}
+		err = parsed[i].validate()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return parsed, nil
+}
+
+// RegistryKeychain authenticates against registries following the first rule matching their host. Credentials are
+// kept until they expire, ECR tokens, or for TTL otherwise.
+type RegistryKeychain struct {
+	Rules []RegistryAuthRule
+	// Fallback resolves the registries matched by no rule, anonymous access when nil
+	Fallback authn.Keychain
+	// Secrets reads the secrets of RegistryAuthSecretsManager rules, a SecretsManagerSource when nil
+	Secrets Source
+	// ECR returns a client for a region, one created from the environment when nil
+	ECR func(region string) (ecriface.ECRAPI, error)
+	// Timeout bounds the retrieval of credentials, DefaultRegistryAuthTimeout when 0
+	Timeout time.Duration
+	// TTL is how long credentials other than ECR tokens are kept, DefaultRegistryAuthTTL when 0
+	TTL time.Duration
+
+	now       func() time.Time
+	mu        sync.Mutex
+	secrets   Source
+	cache     map[string]cachedCredentials
+	ecrClient map[string]ecriface.ECRAPI
+}
+
+type cachedCredentials struct {
+	config  authn.AuthConfig
+	expires time.Time
+}
+
+func (k *RegistryKeychain) clock() time.Time {
+	if k.now != nil {
+		return k.now()
+	}
+	return time.Now()
+}
+
+// rule returns the first rule matching host. Docker Hub is known as index.docker.io to registry clients and as
+// docker.io to most people, rules match either name.
+func (k *RegistryKeychain) rule(host string) *RegistryAuthRule {
+	hosts := []string{host}
+	switch host {
+	case name.DefaultRegistry:
+		hosts = append(hosts, dockerHub)
+	case dockerHub:
+		hosts = append(hosts, name.DefaultRegistry)
+	}
+	for i := range k.Rules {
+		for _, h := range hosts {
+			if matched, _ := path.Match(k.Rules[i].Registry, h); matched {
+				return &k.Rules[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Resolve implements authn.Keychain
+func (k *RegistryKeychain) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	host := target.RegistryStr()
+	rule := k.rule(host)
+	if rule == nil {
+		if k.Fallback == nil {
+			return authn.Anonymous, nil
+		}
+		return k.Fallback.Resolve(target)
+	}
+	if rule.Type == RegistryAuthAnonymous {
+		return authn.Anonymous, nil
+	}
+
+	// credentials are retrieved one at a time, concurrent pulls wait for them instead of requesting their own
+	key := rule.Type + "|" + rule.Registry + "|" + host
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if cached, ok := k.cache[key]; ok && k.clock().Before(cached.expires) {
+		return authn.FromConfig(cached.config), nil
+	}
+
+	timeout := k.Timeout
+	if timeout == 0 {
+		timeout = DefaultRegistryAuthTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var credentials cachedCredentials
+	var err error
+	switch rule.Type {
+	case RegistryAuthECR:
+		credentials, err = k.ecrCredentials(ctx, host)
+	case RegistryAuthSecretsManager:
+		credentials, err = k.secretCredentials(ctx, rule.Secret)
+	case RegistryAuthDockerConfig:
+		credentials, err = k.dockerConfigCredentials(rule.Path, target)
+	default:
+		err = fmt.Errorf("unknown type %q", rule.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve credentials of %s: %w", host, err)
+	}
+
+	if k.cache == nil {
+		k.cache = make(map[string]cachedCredentials)
+	}
+	k.cache[key] = credentials
+	return authn.FromConfig(credentials.config), nil
+}
+
+func (k *RegistryKeychain) ttl() time.Time {
+	ttl := k.TTL
+	if ttl == 0 {
+		ttl = DefaultRegistryAuthTTL
+	}
+	return k.clock().Add(ttl)
+}
+
+func (k *RegistryKeychain) ecrCredentials(ctx context.Context, host string) (cachedCredentials, error) {
+	match := ecrHost.FindStringSubmatch(host)
+	if match == nil {
+		return cachedCredentials{}, fmt.Errorf("%s is not an ECR registry", host)
+	}
+	account, region := match[1], match[3]
+
+	svc, err := k.ecrFor(region)
+	if err != nil {
+		return cachedCredentials{}, err
+	}
+	out, err := svc.GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{
+		RegistryIds: []*string{aws.String(account)},
+	})
+	if err != nil {
+		return cachedCredentials{}, fmt.Errorf("could not get ECR token: %w", err)
+	}
+	if len(out.AuthorizationData) == 0 || out.AuthorizationData[0].AuthorizationToken == nil {
+		return cachedCredentials{}, fmt.Errorf("ECR returned no token")
+	}
+	data := out.AuthorizationData[0]
+	token, err := base64.StdEncoding.DecodeString(*data.AuthorizationToken)
+	if err != nil {
+		return cachedCredentials{}, fmt.Errorf("could not decode ECR token: %w", err)
+	}
+	username, password, ok := strings.Cut(string(token), ":")
+	if !ok {
+		return cachedCredentials{}, fmt.Errorf("ECR token is not user:password")
+	}
+
+	expires := k.ttl()
+	if data.ExpiresAt != nil {
+		expires = data.ExpiresAt.Add(-ecrTokenMargin)
+	}
+	return cachedCredentials{authn.AuthConfig{Username: username, Password: password}, expires}, nil
+}
+
+func (k *RegistryKeychain) ecrFor(region string) (ecriface.ECRAPI, error) {
+	if k.ECR != nil {
+		return k.ECR(region)
+	}
+	if c, ok := k.ecrClient[region]; ok {
+		return c, nil
+	}
+	sess, err := newAWSSession(aws.NewConfig().WithRegion(region))
+	if err != nil {
+		return nil, err
+	}
+	if k.ecrClient == nil {
+		k.ecrClient = make(map[string]ecriface.ECRAPI)
+	}
+	k.ecrClient[region] = ecr.New(sess)
+	return k.ecrClient[region], nil
+}
+
+func (k *RegistryKeychain) secretCredentials(ctx context.Context, secret string) (cachedCredentials, error) {
+	source := k.Secrets
+	if source == nil {
+		if k.secrets == nil {
+			k.secrets = &SecretsManagerSource{}
+		}
+		source = k.secrets
+	}
+	data, err := source.Fetch(ctx, secret)
+	if err != nil {
+		return cachedCredentials{}, err
+	}
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	err = json.Unmarshal(data, &credentials)
+	if err != nil || credentials.Username == "" || credentials.Password == "" {
+		return cachedCredentials{}, fmt.Errorf(`secret %s must be {"username": "...", "password": "..."}`, secret)
+	}
+	return cachedCredentials{authn.AuthConfig{Username: credentials.Username, Password: credentials.Password}, k.ttl()}, nil
+}
+
+func (k *RegistryKeychain) dockerConfigCredentials(configPath string, target authn.Resource) (cachedCredentials, error) {
+	f, err := os.Open(configPath)
+	if err != nil {
+		return cachedCredentials{}, err
+	}
+	defer f.Close()
+	cf, err := dockerconfig.LoadFromReader(f)
+	if err != nil {
+		return cachedCredentials{}, fmt.Errorf("could not parse %s: %w", configPath, err)
+	}
+	cf.Filename = configPath
+	config, err := dockerAuthConfig(cf, target)
+	if err != nil {
+		return cachedCredentials{}, fmt.Errorf("could not read credentials from %s: %w", configPath, err)
+	}
+	return cachedCredentials{config, k.ttl()}, nil
+}
+
+// dockerAuthConfig looks target up like docker does, Docker Hub credentials are stored under a legacy key
+func dockerAuthConfig(cf *configfile.ConfigFile, target authn.Resource) (authn.AuthConfig, error) {
+	for _, key := range []string{target.String(), target.RegistryStr()} {
+		if key == name.DefaultRegistry {
+			key = authn.DefaultAuthKey
+		}
+		cfg, err := cf.GetAuthConfig(key)
+		if err != nil {
+			return authn.AuthConfig{}, err
+		}
+		config := authn.AuthConfig{
+			Username:      cfg.Username,
+			Password:      cfg.Password,
+			Auth:          cfg.Auth,
+			IdentityToken: cfg.IdentityToken,
+			RegistryToken: cfg.RegistryToken,
+		}
+		if config != (authn.AuthConfig{}) {
+			return config, nil
+		}
+	}
+	return authn.AuthConfig{}, nil
+}
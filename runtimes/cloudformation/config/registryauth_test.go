@@ -0,0 +1,198 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/crane"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeECR struct {
+	ecriface.ECRAPI
+	region  string
+	calls   int
+	expires time.Time
+}
+
+func (f *fakeECR) GetAuthorizationTokenWithContext(_ aws.Context, input *ecr.GetAuthorizationTokenInput, _ ...request.Option) (*ecr.GetAuthorizationTokenOutput, error) {
+	f.calls++
+	token := base64.StdEncoding.EncodeToString([]byte("AWS:" + f.region + "-" + *input.RegistryIds[0]))
+	return &ecr.GetAuthorizationTokenOutput{AuthorizationData: []*ecr.AuthorizationData{{
+		AuthorizationToken: aws.String(token),
+		ExpiresAt:          aws.Time(f.expires),
+	}}}, nil
+}
+
+func authorization(t *testing.T, k authn.Keychain, registry string) *authn.AuthConfig {
+	t.Helper()
+	r, err := name.NewRegistry(registry)
+	require.NoError(t, err)
+	auth, err := k.Resolve(r)
+	require.NoError(t, err)
+	config, err := auth.Authorization()
+	require.NoError(t, err)
+	return config
+}
+
+func TestParseRegistryAuthRules(t *testing.T) {
+	rules, err := ParseRegistryAuthRules(`[{"registry": "*.dkr.ecr.*.amazonaws.com", "type": "ecr"}, {"registry": "docker.io", "type": "secretsmanager"}]`, "image-auth")
+	require.NoError(t, err)
+	assert.Equal(t, []RegistryAuthRule{
+		{Registry: "*.dkr.ecr.*.amazonaws.com", Type: RegistryAuthECR},
+		{Registry: "docker.io", Type: RegistryAuthSecretsManager, Secret: "image-auth"},
+	}, rules)
+
+	rules, err = ParseRegistryAuthRules("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, rules)
+
+	for rules, expected := range map[string]string{
+		`{}`:                                 "expected a JSON list",
+		`[{"type": "ecr"}]`:                  "missing registry",
+		`[{"registry": "[", "type": "ecr"}]`: "invalid registry pattern",
+		`[{"registry": "docker.io", "type": "password"}]`:       "unknown type",
+		`[{"registry": "docker.io", "type": "secretsmanager"}]`: "missing secret",
+		`[{"registry": "docker.io", "type": "dockerconfig"}]`:   "missing path",
+	} {
+		_, err := ParseRegistryAuthRules(rules, "")
+		assert.ErrorContains(t, err, expected, rules)
+	}
+}
+
+func TestRegistryKeychain(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clients := make(map[string]*fakeECR)
+
+	dockerConfig := filepath.Join(t.TempDir(), "config.json")
+	auth := base64.StdEncoding.EncodeToString([]byte("docker-user:docker-password"))
+	require.NoError(t, os.WriteFile(dockerConfig, []byte(`{"auths": {"registry.example.com": {"auth": "`+auth+`"}}}`), 0o600))
+
+	secretCalls := 0
+	k := &RegistryKeychain{
+		Rules: []RegistryAuthRule{
+			{Registry: "public.example.com", Type: RegistryAuthAnonymous},
+			{Registry: "*.dkr.ecr.*.amazonaws.com", Type: RegistryAuthECR},
+			{Registry: "registry.example.com", Type: RegistryAuthDockerConfig, Path: dockerConfig},
+			{Registry: "*.example.com", Type: RegistryAuthSecretsManager, Secret: "registry-credentials"},
+		},
+		Secrets: SourceFunc(func(_ context.Context, secret string) ([]byte, error) {
+			secretCalls++
+			return []byte(`{"username": "secret-user", "password": "secret-password"}`), nil
+		}),
+		ECR: func(region string) (ecriface.ECRAPI, error) {
+			if clients[region] == nil {
+				clients[region] = &fakeECR{region: region, expires: now.Add(12 * time.Hour)}
+			}
+			return clients[region], nil
+		},
+		now: func() time.Time { return now },
+	}
+
+	config := authorization(t, k, "123456789012.dkr.ecr.eu-west-1.amazonaws.com")
+	assert.Equal(t, &authn.AuthConfig{Username: "AWS", Password: "eu-west-1-123456789012"}, config)
+	authorization(t, k, "123456789012.dkr.ecr.eu-west-1.amazonaws.com")
+	assert.Equal(t, 1, clients["eu-west-1"].calls)
+	// tokens are renewed before they expire
+	now = now.Add(11*time.Hour + 56*time.Minute)
+	authorization(t, k, "123456789012.dkr.ecr.eu-west-1.amazonaws.com")
+	assert.Equal(t, 2, clients["eu-west-1"].calls)
+
+	config = authorization(t, k, "registry.example.com")
+	assert.Equal(t, "docker-user", config.Username)
+	assert.Equal(t, "docker-password", config.Password)
+
+	config = authorization(t, k, "other.example.com")
+	assert.Equal(t, &authn.AuthConfig{Username: "secret-user", Password: "secret-password"}, config)
+	authorization(t, k, "other.example.com")
+	assert.Equal(t, 1, secretCalls)
+	now = now.Add(time.Hour)
+	authorization(t, k, "other.example.com")
+	assert.Equal(t, 2, secretCalls)
+
+	assert.Equal(t, &authn.AuthConfig{}, authorization(t, k, "public.example.com"))
+	assert.Equal(t, &authn.AuthConfig{}, authorization(t, k, "quay.io"))
+
+	k.Fallback = authn.NewMultiKeychain(authn.NewKeychainFromHelper(helperFunc(func(server string) (string, string, error) {
+		return "fallback-user", "fallback-password", nil
+	})))
+	assert.Equal(t, "fallback-user", authorization(t, k, "quay.io").Username)
+
+	k.Rules = append([]RegistryAuthRule{{Registry: "ecr.example.org", Type: RegistryAuthECR}}, k.Rules...)
+	r, _ := name.NewRegistry("ecr.example.org")
+	_, err := k.Resolve(r)
+	assert.ErrorContains(t, err, "not an ECR registry")
+}
+
+func TestRegistryKeychainDockerHub(t *testing.T) {
+	for _, pattern := range []string{"docker.io", "index.docker.io"} {
+		k := &RegistryKeychain{
+			Rules: []RegistryAuthRule{{Registry: pattern, Type: RegistryAuthSecretsManager, Secret: "dockerhub"}},
+			Secrets: SourceFunc(func(_ context.Context, secret string) ([]byte, error) {
+				return []byte(`{"username": "hub-user", "password": "hub-password"}`), nil
+			}),
+		}
+		for _, image := range []string{"docker.io/library/nginx", "nginx", "index.docker.io/library/nginx"} {
+			ref, err := name.ParseReference(image)
+			require.NoError(t, err)
+			auth, err := k.Resolve(ref.Context())
+			require.NoError(t, err)
+			config, err := auth.Authorization()
+			require.NoError(t, err)
+			assert.Equal(t, "hub-user", config.Username, "%s with rule %s", image, pattern)
+		}
+	}
+}
+
+type helperFunc func(server string) (string, string, error)
+
+func (f helperFunc) Get(server string) (string, string, error) {
+	return f(server)
+}
+
+func TestRegistryKeychainPull(t *testing.T) {
+	upstream := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok || user != "kilt" || password != "s3cr3t" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kilt"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		upstream.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	basic := authn.FromConfig(authn.AuthConfig{Username: "kilt", Password: "s3cr3t"})
+	pushArtifactWith(t, host+"/kilt/recipe:1.0", crane.WithAuth(basic))
+
+	keychain := &RegistryKeychain{
+		Rules: []RegistryAuthRule{{Registry: "127.0.0.1:*", Type: RegistryAuthSecretsManager, Secret: "kilt-registry"}},
+		Secrets: SourceFunc(func(_ context.Context, secret string) ([]byte, error) {
+			return []byte(`{"username": "kilt", "password": "s3cr3t"}`), nil
+		}),
+	}
+	data, err := (&OCISource{Keychain: keychain}).Fetch(context.Background(), host+"/kilt/recipe:1.0")
+	require.NoError(t, err)
+	assert.Equal(t, "build {}", string(data))
+
+	_, err = (&OCISource{Keychain: &RegistryKeychain{}}).Fetch(context.Background(), host+"/kilt/recipe:1.0")
+	assert.ErrorContains(t, err, fmt.Sprint(http.StatusUnauthorized))
+}
@@ -1,49 +1,184 @@
 package config
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 
-	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
 
-func FromS3(path string, decompress bool) string {
+// DefaultS3MaxSize is the largest definition read from S3 unless S3Source.MaxSize says otherwise
+const DefaultS3MaxSize = 10 << 20
 
-	sess, err := session.NewSession()
+// S3Source downloads definitions from S3, e.g. s3://bucket/path/to/definition.cfg. The query string can pin the
+// object version and pick the region of the bucket, e.g. s3://bucket/definition.cfg?versionId=abc&region=eu-west-1.
+// Objects are returned as stored, whatever their Content-Encoding, so that integrity checks cover the bytes as
+// uploaded. Compressed objects are read with s3+gz.
+type S3Source struct {
+	// Client is used for every request when set, otherwise a client is created from the environment for every
+	// region on first use
+	Client s3iface.S3API
+	// Region is the default region of buckets, the region of the environment is used when empty
+	Region string
+	// Endpoint replaces the S3 endpoint, e.g. to use an S3 compatible store such as MinIO
+	Endpoint string
+	// ForcePathStyle addresses buckets as part of the path instead of the host name
+	ForcePathStyle bool
+	// MaxSize is the largest object accepted, DefaultS3MaxSize when 0
+	MaxSize int64
 
+	mu      sync.Mutex
+	clients map[string]s3iface.S3API
+	// cache holds the last object read from every location, to revalidate it with its ETag or, for pinned
+	// versions which never change, to skip the request altogether
+	cache map[string]cachedResponse
+}
+
+// s3Location is a parsed s3:// location
+type s3Location struct {
+	bucket    string
+	key       string
+	versionID string
+	region    string
+}
+
+func parseS3Location(path string) (*s3Location, error) {
+	path, query, _ := strings.Cut(path, "?")
+	splitPath := strings.SplitN(path, "/", 2)
+
+	if len(splitPath) != 2 || splitPath[0] == "" || splitPath[1] == "" {
+		return nil, fmt.Errorf("invalid path specified: expected bucket/objectkey, got '%s'", path)
+	}
+
+	values, err := url.ParseQuery(query)
 	if err != nil {
-		panic(fmt.Errorf("could not create aws session: %w", err))
+		return nil, fmt.Errorf("invalid query string %q: %w", query, err)
+	}
+	location := &s3Location{
+		bucket:    splitPath[0],
+		key:       splitPath[1],
+		versionID: values.Get("versionId"),
+		region:    values.Get("region"),
+	}
+	for k := range values {
+		if k != "versionId" && k != "region" {
+			return nil, fmt.Errorf("unknown option %s, expected versionId or region", k)
+		}
 	}
+	return location, nil
+}
 
-	splitPath := strings.SplitN(path, "/", 2)
+func (s *S3Source) client(region string) (s3iface.S3API, error) {
+	if s.Client != nil {
+		return s.Client, nil
+	}
+	if region == "" {
+		region = s.Region
+	}
 
-	if len(splitPath) != 2 {
-		panic(fmt.Errorf("invalid path specified: expected bucket/objectkey, got '%s'", path))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.clients[region]; ok {
+		return c, nil
 	}
 
-	svc := s3.New(sess)
+	cfg := aws.NewConfig()
+	if region != "" {
+		cfg = cfg.WithRegion(region)
+	}
+	if s.Endpoint != "" {
+		cfg = cfg.WithEndpoint(s.Endpoint)
+	}
+	if s.ForcePathStyle {
+		cfg = cfg.WithS3ForcePathStyle(true)
+	}
+	sess, err := newAWSSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if s.clients == nil {
+		s.clients = make(map[string]s3iface.S3API)
+	}
+	s.clients[region] = s3.New(sess)
+	return s.clients[region], nil
+}
 
-	obj, err := svc.GetObject(&s3.GetObjectInput{
-		Bucket: &splitPath[0],
-		Key:    &splitPath[1],
-	})
+func (s *S3Source) Fetch(ctx context.Context, path string) ([]byte, error) {
+	location, err := parseS3Location(path)
+	if err != nil {
+		return nil, err
+	}
 
+	svc, err := s.client(location.region)
 	if err != nil {
-		panic(fmt.Errorf("could not retrieve %s: %w", path, err))
+		return nil, err
 	}
 
-	config, err := ioutil.ReadAll(obj.Body)
-	defer obj.Body.Close()
+	cached, hasCached := s.cached(path)
+	if hasCached && location.versionID != "" {
+		return cached.body, nil
+	}
 
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(location.bucket),
+		Key:    aws.String(location.key),
+	}
+	if location.versionID != "" {
+		input.VersionId = aws.String(location.versionID)
+	}
+	if hasCached && cached.etag != "" {
+		input.IfNoneMatch = aws.String(cached.etag)
+	}
+	// asking for the identity encoding keeps the http client from transparently decompressing gzip objects
+	obj, err := svc.GetObjectWithContext(ctx, input, request.WithSetRequestHeaders(map[string]string{"Accept-Encoding": "identity"}))
+
+	var requestFailure awserr.RequestFailure
+	if hasCached && errors.As(err, &requestFailure) && requestFailure.StatusCode() == http.StatusNotModified {
+		return cached.body, nil
+	}
 	if err != nil {
-		panic(fmt.Errorf("could not read %s: %w", path, err))
+		return nil, fmt.Errorf("could not retrieve %s: %w", path, err)
 	}
+	defer obj.Body.Close()
 
-	if decompress {
-		config = decompressBytes(config)
+	maxSize := s.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultS3MaxSize
+	}
+	if obj.ContentLength != nil && *obj.ContentLength > maxSize {
+		return nil, fmt.Errorf("%s is %d bytes, more than the %d allowed", path, *obj.ContentLength, maxSize)
+	}
+
+	config, err := readLimited(obj.Body, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %w", path, err)
 	}
 
-	return string(config)
+	s.store(path, cachedResponse{aws.StringValue(obj.ETag), config})
+	return config, nil
+}
+
+func (s *S3Source) cached(path string) (cachedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.cache[path]
+	return c, ok
+}
+
+func (s *S3Source) store(path string, response cachedResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cache == nil {
+		s.cache = make(map[string]cachedResponse)
+	}
+	s.cache[path] = response
 }
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3SourceEndpoint(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	compressed := gzipped(t, "compressed definition")
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/bucket/kilt.cfg":
+			requests++
+			if r.Header.Get("If-None-Match") == `"latest"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"latest"`)
+			if r.URL.Query().Get("versionId") == "v1" {
+				_, _ = w.Write([]byte("first version"))
+				return
+			}
+			_, _ = w.Write([]byte("latest version"))
+		case "/bucket/kilt.cfg.gz":
+			w.Header().Set("Content-Encoding", "gzip")
+			_, _ = w.Write(compressed)
+		case "/bucket/large.cfg":
+			_, _ = w.Write(make([]byte, 100))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	s := &S3Source{
+		Region:         "us-east-1",
+		Endpoint:       server.URL,
+		ForcePathStyle: true,
+		MaxSize:        50,
+	}
+	tests := []struct {
+		location string
+		expected string
+	}{
+		{"bucket/kilt.cfg", "latest version"},
+		{"bucket/kilt.cfg?versionId=v1", "first version"},
+		{"bucket/kilt.cfg?region=eu-west-1", "latest version"},
+		// compressed objects are returned as stored, for s3+gz to decompress once they are verified
+		{"bucket/kilt.cfg.gz", string(compressed)},
+	}
+	for _, tc := range tests {
+		data, err := s.Fetch(context.Background(), tc.location)
+		assert.NoError(t, err, tc.location)
+		assert.Equal(t, tc.expected, string(data), tc.location)
+	}
+
+	registry := NewRegistry()
+	registry.Register("s3", s)
+	data, err := registry.Fetch(context.Background(), "s3+gz://bucket/kilt.cfg.gz")
+	assert.NoError(t, err)
+	assert.Equal(t, "compressed definition", string(data))
+	// integrity covers the object as uploaded
+	sum := sha256.Sum256(compressed)
+	data, err = registry.FetchVerified(context.Background(), "s3+gz://bucket/kilt.cfg.gz", &Integrity{SHA256: hex.EncodeToString(sum[:])})
+	assert.NoError(t, err)
+	assert.Equal(t, "compressed definition", string(data))
+
+	// cached objects are revalidated, pinned versions are not requested again
+	requests = 0
+	for _, location := range []string{"bucket/kilt.cfg", "bucket/kilt.cfg?versionId=v1"} {
+		data, err := s.Fetch(context.Background(), location)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, data)
+	}
+	assert.Equal(t, 1, requests)
+
+	for _, location := range []string{"bucket/large.cfg", "bucket/missing.cfg", "bucket/kilt.cfg?version=v1", "bucket"} {
+		_, err := s.Fetch(context.Background(), location)
+		assert.Error(t, err, location)
+	}
+}
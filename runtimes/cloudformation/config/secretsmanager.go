@@ -0,0 +1,57 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+)
+
+// SecretsManagerSource reads definitions from Secrets Manager, e.g. secretsmanager://kilt-definition or the ARN of
+// the secret. A client is created from the environment on first use unless Client is set.
+type SecretsManagerSource struct {
+	Client secretsmanageriface.SecretsManagerAPI
+	once   sync.Once
+	err    error
+}
+
+func (s *SecretsManagerSource) client() (secretsmanageriface.SecretsManagerAPI, error) {
+	s.once.Do(func() {
+		if s.Client != nil {
+			return
+		}
+		sess, err := newAWSSession()
+		if err != nil {
+			s.err = err
+			return
+		}
+		s.Client = secretsmanager.New(sess)
+	})
+	return s.Client, s.err
+}
+
+func (s *SecretsManagerSource) Fetch(ctx context.Context, secretID string) ([]byte, error) {
+	if secretID == "" {
+		return nil, fmt.Errorf("missing secret id")
+	}
+	svc, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	out, err := svc.GetSecretValueWithContext(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve secret %s: %w", secretID, err)
+	}
+	if out.SecretString != nil {
+		return []byte(*out.SecretString), nil
+	}
+	if out.SecretBinary != nil {
+		return out.SecretBinary, nil
+	}
+	return nil, fmt.Errorf("secret %s has no value", secretID)
+}
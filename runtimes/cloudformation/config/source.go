@@ -0,0 +1,266 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// GzSuffix appended to a scheme, e.g. s3+gz://bucket/key, decompresses what the source returns
+const GzSuffix = "+gz"
+
+// Source retrieves definitions from a backend. location is what follows "<scheme>://" in the URI.
+type Source interface {
+	Fetch(ctx context.Context, location string) ([]byte, error)
+}
+
+// AttestedSource is a Source whose content is authenticated through another document, e.g. the layers of an OCI
+// artifact through its manifest, which pins their digests. Integrity checks apply to that document.
+type AttestedSource interface {
+	Source
+	FetchAttested(ctx context.Context, location string) (data []byte, attestation []byte, err error)
+}
+
+// SourceFunc adapts a function to Source
+type SourceFunc func(ctx context.Context, location string) ([]byte, error)
+
+func (f SourceFunc) Fetch(ctx context.Context, location string) ([]byte, error) {
+	return f(ctx, location)
+}
+
+// Registry maps URI schemes to the Source handling them
+type Registry struct {
+	mu      sync.RWMutex
+	sources map[string]Source
+}
+
+// NewRegistry returns a registry with the built-in sources: file, base64, http, https, s3, ssm, secretsmanager
+// and oci
+func NewRegistry() *Registry {
+	r := &Registry{sources: make(map[string]Source)}
+	r.Register("file", FileSource{})
+	r.Register("base64", Base64Source{})
+	r.Register("http", &WebSource{Scheme: "http"})
+	r.Register("https", &WebSource{Scheme: "https"})
+	r.Register("s3", &S3Source{})
+	r.Register("ssm", &SSMSource{})
+	r.Register("secretsmanager", &SecretsManagerSource{})
+	r.Register("oci", &OCISource{})
+	return r
+}
+
+// DefaultRegistry is used by Register, Fetch and Load
+var DefaultRegistry = NewRegistry()
+
+// Register makes source handle scheme, replacing any source previously registered for it
+func (r *Registry) Register(scheme string, source Source) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sources[strings.ToLower(scheme)] = source
+}
+
+// Schemes lists the registered schemes
+func (r *Registry) Schemes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	schemes := make([]string, 0, len(r.sources))
+	for scheme := range r.sources {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Fetch retrieves the definition at uri, e.g. s3://bucket/key, ssm:///kilt/definition or file+gz:///tmp/kilt.cfg.gz
+func (r *Registry) Fetch(ctx context.Context, uri string) ([]byte, error) {
+	return r.FetchVerified(ctx, uri, nil)
+}
+
+// FetchVerified retrieves the definition at uri and checks it against integrity, when not nil, before it is
+// decompressed. Nothing is returned unless the checks pass.
+func (r *Registry) FetchVerified(ctx context.Context, uri string, integrity *Integrity) ([]byte, error) {
+	scheme, location, decompress, err := splitURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	data, attestation, err := r.fetch(ctx, scheme, location)
+	if err != nil {
+		return nil, err
+	}
+	if integrity != nil {
+		err = integrity.verify(ctx, r, scheme, location, attestation)
+		if err != nil {
+			return nil, fmt.Errorf("could not verify %s: %w", redact(scheme, location), err)
+		}
+	}
+	if decompress {
+		data, err = decompressBytes(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress %s: %w", redact(scheme, location), err)
+		}
+	}
+	return data, nil
+}
+
+// fetch returns what source of scheme holds at location, and what integrity checks apply to: the data itself or the
+// attestation of an AttestedSource
+func (r *Registry) fetch(ctx context.Context, scheme, location string) ([]byte, []byte, error) {
+	source, err := r.source(scheme)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var data, attestation []byte
+	if attested, ok := source.(AttestedSource); ok {
+		data, attestation, err = attested.FetchAttested(ctx, location)
+	} else {
+		data, err = source.Fetch(ctx, location)
+		attestation = data
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not fetch %s: %w", redact(scheme, location), err)
+	}
+	return data, attestation, nil
+}
+
+func (r *Registry) source(scheme string) (Source, error) {
+	r.mu.RLock()
+	source, ok := r.sources[scheme]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q, expected one of %s", ErrUnknownType, scheme, strings.Join(r.Schemes(), ", "))
+	}
+	return source, nil
+}
+
+// LoadArtifact loads the definition and the recipe config of the OCI artifact at uri, e.g.
+// oci://registry.example.com/kilt/recipe:1.0, from a single manifest. integrity, when not nil, is checked against the
+// manifest, which pins both of them. recipeConfig is empty when the artifact has none.
+func (r *Registry) LoadArtifact(ctx context.Context, uri string, integrity *Integrity) (definition string, recipeConfig string, err error) {
+	scheme, location, decompress, err := splitURI(uri)
+	if err != nil {
+		return "", "", err
+	}
+	if scheme != OCI || decompress || strings.Contains(location, "#") {
+		return "", "", fmt.Errorf("%s is not an OCI artifact", redact(scheme, location))
+	}
+	source, err := r.source(scheme)
+	if err != nil {
+		return "", "", err
+	}
+	oci, ok := source.(*OCISource)
+	if !ok {
+		return "", "", fmt.Errorf("the %s scheme is not handled by an OCISource", scheme)
+	}
+
+	artifact, err := oci.FetchArtifact(ctx, location)
+	if err != nil {
+		return "", "", fmt.Errorf("could not fetch %s: %w", redact(scheme, location), err)
+	}
+	if integrity != nil {
+		err = integrity.verify(ctx, r, scheme, location, artifact.Manifest)
+		if err != nil {
+			return "", "", fmt.Errorf("could not verify %s: %w", redact(scheme, location), err)
+		}
+	}
+	return string(artifact.Definition), string(artifact.RecipeConfig), nil
+}
+
+// splitURI returns the lower case scheme of uri without GzSuffix, what follows it and whether GzSuffix was present
+func splitURI(uri string) (scheme string, location string, decompress bool, err error) {
+	scheme, location, ok := strings.Cut(uri, "://")
+	if !ok {
+		return "", "", false, fmt.Errorf("invalid definition location %q: expected <scheme>://<location>", uri)
+	}
+	scheme, decompress = strings.CutSuffix(strings.ToLower(scheme), GzSuffix)
+	return scheme, location, decompress, nil
+}
+
+// redact keeps inline payloads out of error messages
+func redact(scheme, location string) string {
+	if scheme == "base64" {
+		return "base64 payload"
+	}
+	return scheme + "://" + location
+}
+
+// Register makes source handle scheme in the DefaultRegistry
+func Register(scheme string, source Source) {
+	DefaultRegistry.Register(scheme, source)
+}
+
+// Fetch retrieves the definition at uri from the DefaultRegistry
+func Fetch(ctx context.Context, uri string) ([]byte, error) {
+	return DefaultRegistry.Fetch(ctx, uri)
+}
+
+// LoadArtifact loads an OCI artifact from the DefaultRegistry
+func LoadArtifact(ctx context.Context, uri string, integrity *Integrity) (string, string, error) {
+	return DefaultRegistry.LoadArtifact(ctx, uri, integrity)
+}
+
+// FromS3 retrieves the definition at bucket/key from S3
+//
+// Deprecated: use Fetch with an s3:// or s3+gz:// URI
+func FromS3(path string, decompress bool) (string, error) {
+	return fetchString(S3, path, decompress)
+}
+
+// FromWeb retrieves the definition at url
+//
+// Deprecated: use Fetch
+func FromWeb(url string) (string, error) {
+	data, err := Fetch(context.Background(), url)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// FromBase64 decodes an inline definition
+//
+// Deprecated: use Fetch with a base64:// or base64+gz:// URI
+func FromBase64(payload string, decompress bool) (string, error) {
+	return fetchString(Base64, payload, decompress)
+}
+
+func fetchString(scheme, location string, decompress bool) (string, error) {
+	if decompress {
+		scheme += GzSuffix
+	}
+	data, err := Fetch(context.Background(), scheme+"://"+location)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Load retrieves a definition given a KILT_DEFINITION_TYPE, one of the constants in types.go, and a
+// KILT_DEFINITION. The URI type, or no type at all, takes the definition as a URI. The definition is checked against
+// integrity when it is not nil.
+func Load(ctx context.Context, definitionType, definition string, integrity *Integrity) (string, error) {
+	uri, err := DefinitionURI(definitionType, definition)
+	if err != nil {
+		return "", err
+	}
+	data, err := DefaultRegistry.FetchVerified(ctx, uri, integrity)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// DefinitionURI turns a KILT_DEFINITION_TYPE and KILT_DEFINITION pair into a URI
+func DefinitionURI(definitionType, definition string) (string, error) {
+	switch definitionType {
+	case "", URI, Http:
+		return definition, nil
+	case S3, S3Gz, Base64, Base64Gz, OCI:
+		return definitionType + "://" + definition, nil
+	default:
+		return "", fmt.Errorf("%w %q, expected one of %s, %s, %s, %s, %s, %s or %s", ErrUnknownType, definitionType, URI, S3, S3Gz, Http, Base64, Base64Gz, OCI)
+	}
+}
@@ -0,0 +1,137 @@
+package config
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string]string
+}
+
+func (f *fakeS3) GetObjectWithContext(_ aws.Context, input *s3.GetObjectInput, _ ...request.Option) (*s3.GetObjectOutput, error) {
+	object, ok := f.objects[*input.Bucket+"/"+*input.Key]
+	if !ok {
+		return nil, errors.New("NoSuchKey")
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(object))}, nil
+}
+
+type fakeSSM struct {
+	ssmiface.SSMAPI
+	parameters map[string]string
+}
+
+func (f *fakeSSM) GetParameterWithContext(_ aws.Context, input *ssm.GetParameterInput, _ ...request.Option) (*ssm.GetParameterOutput, error) {
+	value, ok := f.parameters[*input.Name]
+	if !ok || !*input.WithDecryption {
+		return nil, errors.New("ParameterNotFound")
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssm.Parameter{Value: aws.String(value)}}, nil
+}
+
+type fakeSecretsManager struct {
+	secretsmanageriface.SecretsManagerAPI
+	secrets map[string]string
+}
+
+func (f *fakeSecretsManager) GetSecretValueWithContext(_ aws.Context, input *secretsmanager.GetSecretValueInput, _ ...request.Option) (*secretsmanager.GetSecretValueOutput, error) {
+	value, ok := f.secrets[*input.SecretId]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(value)}, nil
+}
+
+func gzipped(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(s))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestRegistry(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "kilt.cfg"), []byte("from file"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "kilt.cfg.gz"), gzipped(t, "from gzipped file"), 0644))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("from web " + r.URL.Path))
+	}))
+	defer server.Close()
+
+	r := NewRegistry()
+	r.Register("s3", &S3Source{Client: &fakeS3{objects: map[string]string{"bucket/path/kilt.cfg": "from s3"}}})
+	r.Register("ssm", &SSMSource{Client: &fakeSSM{parameters: map[string]string{"/kilt/definition": "from ssm"}}})
+	r.Register("secretsmanager", &SecretsManagerSource{Client: &fakeSecretsManager{secrets: map[string]string{"kilt": "from secrets manager"}}})
+	r.Register("static", SourceFunc(func(_ context.Context, location string) ([]byte, error) {
+		return []byte("static " + location), nil
+	}))
+
+	tests := []struct {
+		uri      string
+		expected string
+	}{
+		{"file://" + filepath.Join(dir, "kilt.cfg"), "from file"},
+		{"file+gz://" + filepath.Join(dir, "kilt.cfg.gz"), "from gzipped file"},
+		{"base64://a2lsdA==", "kilt"},
+		{server.URL + "/kilt.cfg", "from web /kilt.cfg"},
+		{"s3://bucket/path/kilt.cfg", "from s3"},
+		{"ssm:///kilt/definition", "from ssm"},
+		{"secretsmanager://kilt", "from secrets manager"},
+		{"STATIC://definition", "static definition"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.uri, func(t *testing.T) {
+			data, err := r.Fetch(context.Background(), tc.uri)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, string(data))
+		})
+	}
+
+	for _, uri := range []string{"ftp://example.com/kilt.cfg", "kilt.cfg"} {
+		_, err := r.Fetch(context.Background(), uri)
+		assert.Error(t, err, uri)
+	}
+	_, err := r.Fetch(context.Background(), "ftp://example.com/kilt.cfg")
+	assert.ErrorIs(t, err, ErrUnknownType)
+	_, err = r.Fetch(context.Background(), "s3://bucket")
+	assert.Error(t, err)
+	_, err = r.Fetch(context.Background(), "ssm:///kilt/missing")
+	assert.Error(t, err)
+}
+
+func TestLoad(t *testing.T) {
+	definition, err := Load(context.Background(), Base64, "a2lsdA==", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "kilt", definition)
+
+	definition, err = Load(context.Background(), URI, "base64://a2lsdA==", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "kilt", definition)
+
+	_, err = Load(context.Background(), "ftp", "example.com/kilt.cfg", nil)
+	assert.ErrorIs(t, err, ErrUnknownType)
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/aws/aws-sdk-go/service/ssm/ssmiface"
+)
+
+// SSMSource reads definitions from SSM Parameter Store, e.g. ssm:///kilt/definition. SecureString parameters are
+// decrypted. A client is created from the environment on first use unless Client is set.
+type SSMSource struct {
+	Client ssmiface.SSMAPI
+	once   sync.Once
+	err    error
+}
+
+func (s *SSMSource) client() (ssmiface.SSMAPI, error) {
+	s.once.Do(func() {
+		if s.Client != nil {
+			return
+		}
+		sess, err := newAWSSession()
+		if err != nil {
+			s.err = err
+			return
+		}
+		s.Client = ssm.New(sess)
+	})
+	return s.Client, s.err
+}
+
+func (s *SSMSource) Fetch(ctx context.Context, name string) ([]byte, error) {
+	if name == "" {
+		return nil, fmt.Errorf("missing parameter name")
+	}
+	svc, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	out, err := svc.GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not retrieve parameter %s: %w", name, err)
+	}
+	if out.Parameter == nil || out.Parameter.Value == nil {
+		return nil, fmt.Errorf("parameter %s has no value", name)
+	}
+	return []byte(*out.Parameter.Value), nil
+}
@@ -6,4 +6,7 @@ const (
 	Http     = "http"
 	Base64   = "base64"
 	Base64Gz = "base64+gz"
+	OCI      = "oci"
+	// URI takes the definition as a URI handled by one of the sources of the DefaultRegistry
+	URI = "uri"
 )
@@ -4,18 +4,33 @@ import (
 	"bytes"
 	"compress/gzip"
 	"fmt"
-	"io/ioutil"
+	"io"
 )
 
-func decompressBytes(data []byte) []byte {
+// DefaultMaxDecompressedSize bounds what +gz definitions can expand to
+const DefaultMaxDecompressedSize = 50 << 20
+
+func decompressBytes(data []byte) ([]byte, error) {
 	reader, err := gzip.NewReader(bytes.NewBuffer(data))
 	if err != nil {
-		panic(fmt.Errorf("error constructing decompressor: %w", err))
+		return nil, fmt.Errorf("error constructing decompressor: %w", err)
+	}
+
+	decompressedData, err := readLimited(reader, DefaultMaxDecompressedSize)
+	if err != nil {
+		return nil, fmt.Errorf("error reading gzipped stream: %w", err)
 	}
+	return decompressedData, nil
+}
 
-	decompressedData, err := ioutil.ReadAll(reader)
+// readLimited reads r to the end and fails when it holds more than maxSize bytes
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
 	if err != nil {
-		panic(fmt.Errorf("error reading gzipped stream: %w", err))
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, fmt.Errorf("content exceeds %d bytes", maxSize)
 	}
-	return decompressedData
+	return data, nil
 }